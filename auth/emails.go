@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"context"
+	"go-on-rails/common"
+	"log"
+	"strings"
+)
+
+// Registers the emails of this module so admins can edit them (see common/emailtemplate.go).
+// The default HTML is the templ component rendered with the variables as placeholders.
+// It's called by AddRoutes, once the environment is loaded, since the emails include BASE_URL.
+func registerEmails() {
+	var html strings.Builder
+	err := forgot_password_email("{{.ResetURL}}").Render(context.Background(), &html)
+	if err != nil {
+		log.Fatalf("Error rendering the password reset email: %v", err)
+	}
+	common.RegisterEmailTemplate(common.EmailTemplate{
+		Name:        "password_reset",
+		Title:       "Password Reset",
+		Description: "Sent when someone asks to reset their password in the forgot password page.",
+		Subject:     "Password Reset",
+		HTML:        html.String(),
+		Variables: []common.EmailTemplateVariable{
+			{Name: "ResetURL", Description: "Link to the page choosing a new password", Sample: common.Env.BASE_URL + "/reset-password?token=sample-token"},
+		},
+	})
+}
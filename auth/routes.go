@@ -8,6 +8,7 @@ import (
 	"go-on-rails/common"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -15,14 +16,9 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var mailingQueue *common.Queue
-
-func init() {
-	mailingQueue = common.NewQueue(common.QueueOptions{})
-	mailingQueue.StartJobQueue()
-}
-
 func AddRoutes(app *fiber.App) {
+	registerEmails()
+
 	auth := &AuthHandlers{}
 	app.Get("/signup", auth.get_signup)
 	app.Post("/signup", auth.post_signup)
@@ -39,6 +35,9 @@ func AddRoutes(app *fiber.App) {
 	admin := &AdminHandlers{}
 	app.Get("/admin", admin.get_admin)
 	app.Post("/admin/smtp", admin.post_smtp)
+	app.Post("/admin/smtp/test", admin.post_smtp_test)
+	app.Post("/admin/mail-transport", admin.post_mail_transport)
+	app.Post("/admin/dkim", admin.post_dkim)
 	app.Get("/admin/users/:id", admin.get_user)
 	app.Post("/admin/users/:id/reset-password", admin.post_reset_user_password)
 	app.Get("/admin/signup-codes/new", admin.get_new_signup_code)
@@ -47,6 +46,9 @@ func AddRoutes(app *fiber.App) {
 	app.Post("/admin/signup-codes/delete/:code", admin.delete_signup_code)
 	app.Get("/admin/signup-codes/:code", admin.get_edit_signup_code)
 	app.Post("/admin/signup-codes/:code", admin.put_signup_code)
+	app.Get("/admin/cache", admin.get_cache)
+	app.Post("/admin/cache/flush", admin.post_cache_flush)
+	app.Get("/admin/config", admin.get_config)
 }
 
 type AuthHandlers struct {
@@ -383,18 +385,19 @@ func (m *AuthHandlers) post_forgot_pass(c *fiber.Ctx) error {
 		return c.Redirect("/forgot-password?error=Can't insert password reset token into database")
 	}
 
-	// Check if mailer is configured and send email with link to reset password
-	if common.Mailer != nil && common.IsValidMailer(common.Mailer) {
-		mailingQueue.AddJob(common.Job{
-			Name: fmt.Sprintf("send-forgot-password-email-%s", email),
-			Func: func() error {
-				return common.Mailer.SendMail([]string{email}, "Password Reset", common.Env.BASE_URL+"/reset-password?token="+token)
-			},
-			Lockable: true, // don't want to send multiple emails at the same time to the same user
-		})
-	} else {
+	// Check if mailer is configured and queue the email with link to reset password
+	if !common.CanSendMail() {
 		return c.Redirect("/forgot-password?error=Can't send email because mailer is not configured, contact admin")
 	}
+	msg := &common.Message{To: []string{email}}
+	err = msg.SetTemplate("password_reset", map[string]string{"ResetURL": common.Env.BASE_URL + "/reset-password?token=" + token})
+	if err != nil {
+		return c.Redirect("/forgot-password?error=Can't render the password reset email")
+	}
+	_, err = common.QueueMessage(msg)
+	if err != nil {
+		return c.Redirect("/forgot-password?error=Can't send the password reset email because " + err.Error())
+	}
 
 	// redirect to the forgot password page with a success message
 	return c.Redirect("/forgot-password?success=Check your email for a link to reset your password")
@@ -564,7 +567,7 @@ func (m *AdminHandlers) get_admin(c *fiber.Ctx) error {
 
 	// get SMTP settings
 	var smtpSettings SMTPSettings
-	err = common.MailDb.Get(&smtpSettings, `SELECT host, port, username, password FROM mailer_config`)
+	err = common.MailDb.Get(&smtpSettings, `SELECT host, port, username, password, tls_mode, tls_skip_verify, ca_file, from_address, reply_to FROM mailer_config`)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			smtpSettings = SMTPSettings{}
@@ -573,6 +576,29 @@ func (m *AdminHandlers) get_admin(c *fiber.Ctx) error {
 		}
 	}
 
+	_, transport := common.CurrentTransport()
+	_, transportOverride := common.TransportOverride()
+
+	// get DKIM settings and the DNS record to publish
+	dkimSettings := DKIMSettings{Selector: "mail", Algorithm: common.DKIMAlgorithmRSA}
+	dkimConfig, err := common.GetDKIMConfig()
+	if err != nil {
+		dkimSettings.Error = "Can't load the DKIM settings: " + err.Error()
+	} else if dkimConfig != nil {
+		dkimSettings = DKIMSettings{
+			Enabled:   dkimConfig.Enabled,
+			Domain:    dkimConfig.Domain,
+			Selector:  dkimConfig.Selector,
+			Algorithm: dkimConfig.Algorithm,
+			HasKey:    true,
+			CreatedAt: dkimConfig.CreatedAt,
+		}
+		dkimSettings.DNSName, dkimSettings.DNSRecord, err = dkimConfig.DNSRecord()
+		if err != nil {
+			dkimSettings.Error = err.Error()
+		}
+	}
+
 	// render the admin page
 	return common.RenderTempl(c, admin_page(admin_props{
 		Me: me,
@@ -580,9 +606,12 @@ func (m *AdminHandlers) get_admin(c *fiber.Ctx) error {
 			Success: c.Query("success"),
 			Error:   c.Query("error"),
 		},
-		Users:        users,
-		SignupCodes:  signupCodes,
-		SMTPSettings: smtpSettings,
+		Users:             users,
+		SignupCodes:       signupCodes,
+		SMTPSettings:      smtpSettings,
+		Transport:         transport,
+		TransportOverride: transportOverride,
+		DKIM:              dkimSettings,
 	}))
 }
 
@@ -610,29 +639,16 @@ func (m *AdminHandlers) post_smtp(c *fiber.Ctx) error {
 	}
 
 	// validate the form
-	host := c.FormValue("host")
-	port := c.FormValue("port")
-	username := c.FormValue("username")
-	password := c.FormValue("password")
-	intPort, err := strconv.Atoi(port)
-	if err != nil {
-		return c.Redirect("/admin?error=Invalid SMTP settings")
+	config, err := mailerFromForm(c)
+	if err == nil {
+		err = common.ValidateMailer(config)
 	}
-	if !common.IsValidMailer(&common.MailerT{
-		Host:     host,
-		Port:     intPort,
-		Username: username,
-		Password: password,
-	}) {
-		return c.Redirect("/admin?error=Invalid SMTP settings")
+	if err != nil {
+		return c.Redirect("/admin?error=Invalid SMTP settings: " + err.Error())
 	}
 
-	// upsert SMTP settings
-	_, err = common.MailDb.Exec(`
-		INSERT INTO mailer_config (id, host, port, username, password) VALUES (1, ?, ?, ?, ?)
-		ON CONFLICT(id) DO UPDATE SET 
-		host = EXCLUDED.host, port = EXCLUDED.port, username = EXCLUDED.username, password = EXCLUDED.password`,
-		host, intPort, username, password)
+	// save the SMTP settings, the next emails are sent with them
+	err = common.NewMailer(config)
 	if err != nil {
 		return c.Redirect("/admin?error=Can't change SMTP settings because " + err.Error())
 	}
@@ -641,6 +657,123 @@ func (m *AdminHandlers) post_smtp(c *fiber.Ctx) error {
 	return c.Redirect("/admin?success=SMTP settings updated successfully")
 }
 
+// Reads the SMTP settings submitted with the admin SMTP form, without validating them.
+// The password is never sent to the browser, so a blank password means the saved one, but only
+// for the same server, account and TLS settings: otherwise the form could send the saved password
+// to another server, or to the same one over a connection that isn't verified.
+func mailerFromForm(c *fiber.Ctx) (*common.MailerT, error) {
+	port, err := strconv.Atoi(c.FormValue("port"))
+	if err != nil {
+		return nil, fmt.Errorf("port must be a number")
+	}
+	config := &common.MailerT{
+		Host:          c.FormValue("host"),
+		Port:          port,
+		Username:      c.FormValue("username"),
+		Password:      c.FormValue("password"),
+		TLSMode:       c.FormValue("tls_mode"),
+		TLSSkipVerify: c.FormValue("tls_skip_verify") == "true",
+		CAFile:        strings.TrimSpace(c.FormValue("ca_file")),
+		From:          strings.TrimSpace(c.FormValue("from_address")),
+		ReplyTo:       strings.TrimSpace(c.FormValue("reply_to")),
+	}
+	if config.Password != "" {
+		return config, nil
+	}
+
+	current := common.GetMailer()
+	if current == nil || current.Password == "" {
+		return config, nil
+	}
+	if !sameSMTPServer(config, current) {
+		return nil, fmt.Errorf("the password is required when the host, port, username or TLS settings change")
+	}
+	config.Password = current.Password
+	return config, nil
+}
+
+// Returns whether both settings connect to the same server, with the same account and TLS settings.
+func sameSMTPServer(a *common.MailerT, b *common.MailerT) bool {
+	return strings.EqualFold(a.Host, b.Host) && a.Port == b.Port && a.Username == b.Username &&
+		a.TLSMode == b.TLSMode && a.TLSSkipVerify == b.TLSSkipVerify && a.CAFile == b.CAFile
+}
+
+// Tries the submitted SMTP settings without saving them and sends a test email to the admin.
+// The settings are validated by the check itself, so each problem shows up at its step.
+// Called with HTMX, renders the result of each step.
+func (m *AdminHandlers) post_smtp_test(c *fiber.Ctx) error {
+	userId, err := IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	var email string
+	err = AuthDb.Get(&email, `SELECT email FROM users WHERE id = ?`, userId)
+	if err != nil {
+		return common.RenderTempl(c, smtp_test_result("", nil, "Can't get your email address"))
+	}
+
+	config, err := mailerFromForm(c)
+	if err != nil {
+		return common.RenderTempl(c, smtp_test_result(email, nil, "Invalid SMTP settings: "+err.Error()))
+	}
+
+	return common.RenderTempl(c, smtp_test_result(email, config.Check(email), ""))
+}
+
+func (m *AdminHandlers) post_mail_transport(c *fiber.Ctx) error {
+	_, err := IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	if _, reason := common.TransportOverride(); reason != "" {
+		return c.Redirect("/admin?error=Can't change the mail transport. " + reason)
+	}
+	err = common.SetTransport(c.FormValue("transport"))
+	if err != nil {
+		return c.Redirect("/admin?error=Can't change the mail transport because " + err.Error())
+	}
+
+	return c.Redirect("/admin?success=Mail transport updated successfully")
+}
+
+// Saves the DKIM settings, or generates a new key pair when the "generate" button is used.
+func (m *AdminHandlers) post_dkim(c *fiber.Ctx) error {
+	_, err := IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	config, err := common.GetDKIMConfig()
+	if err != nil {
+		return c.Redirect("/admin?error=Can't load the DKIM settings because " + err.Error())
+	}
+	if config == nil {
+		config = &common.DKIMConfig{}
+	}
+	config.Enabled = c.FormValue("enabled") == "true"
+	config.Domain = strings.ToLower(strings.TrimSpace(c.FormValue("domain")))
+	config.Selector = strings.TrimSpace(c.FormValue("selector"))
+
+	success := "DKIM settings updated successfully"
+	if c.FormValue("action") == "generate" {
+		config.Algorithm = c.FormValue("algorithm")
+		config.PrivateKey, err = common.GenerateDKIMKey(config.Algorithm)
+		if err != nil {
+			return c.Redirect("/admin?error=Can't generate the DKIM key because " + err.Error())
+		}
+		config.CreatedAt = time.Now().UTC()
+		success = "DKIM key generated, publish the DNS record so receivers can check the signatures"
+	}
+
+	err = common.SaveDKIMConfig(config)
+	if err != nil {
+		return c.Redirect("/admin?error=Can't save the DKIM settings because " + err.Error())
+	}
+	return c.Redirect("/admin?success=" + success)
+}
+
 func (m *AdminHandlers) get_user(c *fiber.Ctx) error {
 	// get session
 	sess, err := Store.Get(c)
@@ -1000,3 +1133,99 @@ func (m *AdminHandlers) delete_signup_codes(c *fiber.Ctx) error {
 	// redirect to the admin page with a success message
 	return c.Redirect("/admin?success=Deleted " + strconv.Itoa(len(codes)) + " signup codes successfully")
 }
+
+func (m *AdminHandlers) get_cache(c *fiber.Ctx) error {
+	// check if the user is logged in and has the admin role
+	_, err := IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// collect the stats of every registered cache store
+	var stores []cache_store_props
+	for _, name := range common.CacheStoreNames() {
+		store, err := common.GetCacheStore(name)
+		if err != nil {
+			continue
+		}
+		stores = append(stores, cache_store_props{
+			Name:  name,
+			Stats: common.SortedCacheStats(store.Stats()),
+		})
+	}
+
+	// render the cache inspector page
+	return common.RenderTempl(c, admin_cache_page(Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, stores))
+}
+
+func (m *AdminHandlers) post_cache_flush(c *fiber.Ctx) error {
+	// check if the user is logged in and has the admin role
+	_, err := IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// basic validation
+	storeName := c.FormValue("store")
+	prefix := c.FormValue("prefix")
+	if storeName == "" || prefix == "" {
+		return c.Redirect("/admin/cache?error=Please select a cache store and prefix to flush")
+	}
+
+	// flush the prefix
+	store, err := common.GetCacheStore(storeName)
+	if err != nil {
+		return c.Redirect("/admin/cache?error=Can't find cache store " + storeName)
+	}
+	err = store.Flush(prefix)
+	if err != nil {
+		return c.Redirect("/admin/cache?error=Can't flush cache prefix because " + err.Error())
+	}
+
+	// redirect to the cache inspector page with a success message
+	return c.Redirect(fmt.Sprintf("/admin/cache?success=Flushed %s from %s successfully", prefix, storeName))
+}
+
+func (m *AdminHandlers) get_config(c *fiber.Ctx) error {
+	// check if the user is logged in and has the admin role
+	_, err := IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// get SMTP settings
+	var smtpSettings SMTPSettings
+	err = common.MailDb.Get(&smtpSettings, `SELECT host, port, username, password, tls_mode, tls_skip_verify, ca_file, from_address, reply_to FROM mailer_config`)
+	if err != nil && err != sql.ErrNoRows {
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get SMTP settings:", err.Error()))
+	}
+
+	// render the configuration page, never show the password
+	_, transport := common.CurrentTransport()
+
+	return common.RenderTempl(c, admin_config_page(common.EnvInfo, []settings_table{
+		{
+			Name: "mailer_config",
+			Rows: []settings_row{
+				{Key: "host", Value: smtpSettings.Host},
+				{Key: "port", Value: smtpSettings.Port},
+				{Key: "username", Value: smtpSettings.Username},
+				{Key: "password", Value: common.TernaryIf(smtpSettings.Password != "", "[redacted]", "")},
+				{Key: "tls_mode", Value: smtpSettings.TLSMode},
+				{Key: "tls_skip_verify", Value: strconv.FormatBool(smtpSettings.TLSSkipVerify)},
+				{Key: "ca_file", Value: smtpSettings.CAFile},
+				{Key: "from_address", Value: smtpSettings.From},
+				{Key: "reply_to", Value: smtpSettings.ReplyTo},
+			},
+		},
+		{
+			Name: "mail_settings",
+			Rows: []settings_row{
+				{Key: "transport", Value: transport},
+			},
+		},
+	}))
+}
@@ -22,3 +22,23 @@ func IsLoggedIn(c *fiber.Ctx) (int, error) {
 
 	return userId.(int), nil
 }
+
+// Checks if user is logged in and has the admin role. Returns the user ID if so, otherwise returns an error.
+func IsAdmin(c *fiber.Ctx) (int, error) {
+	userId, err := IsLoggedIn(c)
+	if err != nil {
+		return 0, err
+	}
+
+	// check if the user has the admin role
+	var count int
+	err = AuthDb.Get(&count, `SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = "admin"`, userId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user roles: %v", err)
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("user is not an admin")
+	}
+
+	return userId, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// This command generates the .env.example file and the configuration reference (CONFIGURATION.md)
+// from the Environment struct in common/env.go. Run it with `make env-docs` whenever you add
+// or change an environment variable.
+//
+// It reads the source file instead of importing the common package, because the doc comments
+// aren't available at runtime and importing common would open the databases.
+// The trailing comment of a field is its description, the comment above a group of fields is its section.
+
+type envVar struct {
+	Name        string
+	Type        string
+	Default     string
+	HasDefault  bool
+	Required    bool
+	Secret      bool
+	Rules       []string
+	Description string
+}
+
+type envSection struct {
+	Title string
+	Vars  []envVar
+}
+
+func main() {
+	source := flag.String("source", "common/env.go", "Go file that declares the Environment struct")
+	envOut := flag.String("env", ".env.example", "Where to write the example env file")
+	mdOut := flag.String("md", "CONFIGURATION.md", "Where to write the Markdown configuration reference")
+	flag.Parse()
+
+	sections, err := parseEnvironment(*source)
+	if err != nil {
+		log.Fatalf("Error parsing %s: %v", *source, err)
+	}
+
+	err = os.WriteFile(*envOut, []byte(renderEnvExample(sections, *source)), 0644)
+	if err != nil {
+		log.Fatalf("Error writing %s: %v", *envOut, err)
+	}
+	log.Printf("Wrote %s", *envOut)
+
+	err = os.WriteFile(*mdOut, []byte(renderMarkdown(sections, *source)), 0644)
+	if err != nil {
+		log.Fatalf("Error writing %s: %v", *mdOut, err)
+	}
+	log.Printf("Wrote %s", *mdOut)
+}
+
+// Finds the Environment struct in the source file and describes its fields, grouped by section.
+func parseEnvironment(path string) ([]envSection, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var structType *ast.StructType
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if ok && spec.Name.Name == "Environment" {
+			structType, _ = spec.Type.(*ast.StructType)
+			return false
+		}
+		return structType == nil
+	})
+	if structType == nil {
+		return nil, fmt.Errorf("Environment struct not found")
+	}
+
+	sections := []envSection{{Title: "General"}}
+	for _, field := range structType.Fields.List {
+		if field.Tag == nil {
+			continue
+		}
+		rawTag, err := strconv.Unquote(field.Tag.Value)
+		if err != nil {
+			return nil, err
+		}
+		tag := reflect.StructTag(rawTag)
+		name, ok := tag.Lookup("env")
+		if !ok {
+			continue
+		}
+
+		// a comment above the field starts a new section
+		if field.Doc != nil {
+			sections = append(sections, envSection{Title: strings.TrimSpace(field.Doc.Text())})
+		}
+
+		var typ bytes.Buffer
+		printer.Fprint(&typ, fset, field.Type)
+		defaultValue, hasDefault := tag.Lookup("default")
+		v := envVar{
+			Name:       name,
+			Type:       typ.String(),
+			Default:    defaultValue,
+			HasDefault: hasDefault,
+			Required:   !hasDefault,
+			Secret:     tag.Get("secret") == "true",
+		}
+		if field.Comment != nil {
+			v.Description = strings.TrimSpace(field.Comment.Text())
+		}
+		if rules := tag.Get("validate"); rules != "" {
+			for _, rule := range strings.Split(rules, ",") {
+				rule = strings.TrimSpace(rule)
+				if rule == "required" {
+					v.Required = true
+				}
+				v.Rules = append(v.Rules, rule)
+			}
+		}
+		if pattern, ok := tag.Lookup("pattern"); ok {
+			v.Rules = append(v.Rules, "pattern="+pattern)
+		}
+		sections[len(sections)-1].Vars = append(sections[len(sections)-1].Vars, v)
+	}
+
+	// drop the default section if every field has one
+	if len(sections[0].Vars) == 0 {
+		sections = sections[1:]
+	}
+	return sections, nil
+}
+
+func renderEnvExample(sections []envSection, source string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated from %s by `make env-docs`, do not edit by hand.\n", source)
+	b.WriteString("# Copy it to .env (or .env.local) and adjust the values.\n")
+	b.WriteString("# Any variable can also be read from a file with <NAME>_FILE (e.g. Docker secrets).\n")
+	for _, section := range sections {
+		fmt.Fprintf(&b, "\n# --- %s ---\n", section.Title)
+		for _, v := range section.Vars {
+			b.WriteString("\n")
+			if v.Description != "" {
+				fmt.Fprintf(&b, "# %s\n", v.Description)
+			}
+			details := []string{"Type: " + v.Type}
+			if v.Required {
+				details = append(details, "Required")
+			}
+			if v.Secret {
+				details = append(details, "Secret")
+			}
+			if len(v.Rules) > 0 {
+				details = append(details, "Rules: "+strings.Join(v.Rules, ", "))
+			}
+			fmt.Fprintf(&b, "# %s\n", strings.Join(details, ". "))
+
+			// never put secret defaults in the example
+			value := v.Default
+			if v.Secret {
+				value = ""
+			}
+			fmt.Fprintf(&b, "%s=%s\n", v.Name, value)
+		}
+	}
+	return b.String()
+}
+
+func renderMarkdown(sections []envSection, source string) string {
+	var b strings.Builder
+	b.WriteString("# Configuration\n\n")
+	fmt.Fprintf(&b, "<!-- Generated from %s by `make env-docs`, do not edit by hand. -->\n\n", source)
+	b.WriteString("The app is configured with environment variables. They are read from the process environment, ")
+	b.WriteString("then `.env.local`, `.env.<ENVIRONMENT>` and `.env`. Any variable can also be read from a file ")
+	b.WriteString("by setting `<NAME>_FILE` to its path (e.g. Docker secrets). Secret values are never logged.\n")
+	b.WriteString("See `.env.example` for a starting point.\n")
+	for _, section := range sections {
+		fmt.Fprintf(&b, "\n## %s\n\n", section.Title)
+		b.WriteString("| Variable | Type | Default | Required | Validation | Description |\n")
+		b.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+		for _, v := range section.Vars {
+			defaultValue := "-"
+			if v.HasDefault && v.Default != "" {
+				defaultValue = "`" + v.Default + "`"
+			}
+			if v.Secret && v.HasDefault && v.Default != "" {
+				defaultValue = "_(secret)_"
+			}
+			rules := "-"
+			if len(v.Rules) > 0 {
+				rules = "`" + strings.Join(v.Rules, "`, `") + "`"
+			}
+			description := v.Description
+			if v.Secret {
+				description = strings.TrimSpace(description + " (secret)")
+			}
+			fmt.Fprintf(&b, "| `%s` | `%s` | %s | %s | %s | %s |\n",
+				v.Name, v.Type, defaultValue, yesNo(v.Required), escapeCell(rules), escapeCell(description))
+		}
+	}
+	return b.String()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// Escapes the characters that would break a Markdown table cell.
+func escapeCell(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
@@ -1,5 +1,14 @@
 package common
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
 type Promise[T any] struct {
 	ResultCh chan T
 	ErrorCh  chan error
@@ -12,6 +21,28 @@ func (p Promise[T]) Wait() (T, error) {
 	return res, err
 }
 
+// Waits for the promise like Wait, but returns early with ctx.Err() if the context
+// is cancelled or its deadline passes first. The promise keeps running in the background
+// and its result is discarded.
+func (p Promise[T]) WaitContext(ctx context.Context) (T, error) {
+	select {
+	case err := <-p.ErrorCh:
+		res := <-p.ResultCh
+		return res, err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Waits for the promise for at most the given duration.
+// Returns context.DeadlineExceeded if the promise didn't settle in time.
+func (p Promise[T]) WaitTimeout(timeout time.Duration) (T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.WaitContext(ctx)
+}
+
 func (p Promise[T]) Close() {
 	close(p.ErrorCh)
 	close(p.ResultCh)
@@ -26,10 +57,248 @@ func Async[T any](fn func() (T, error)) Promise[T] {
 	go func() {
 		defer p.Close()
 
-		res, err := fn()
+		res, err := safeCall(fn)
 		p.ResultCh <- res
 		p.ErrorCh <- err
 	}()
 
 	return p
 }
+
+// Returned (through the ErrorCh) by a promise whose function panicked.
+// The panic is recovered so it doesn't crash the whole server.
+type PanicError struct {
+	Value any    // The value passed to panic.
+	Stack []byte // The stack trace of the goroutine at the time of the panic.
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Allows errors.Is / errors.As to match the value passed to panic, if it's an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Calls fn and turns a panic into a PanicError.
+func safeCall[T any](fn func() (T, error)) (res T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var zero T
+			res, err = zero, &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// Same as Async, but passes the context to fn and settles with ctx.Err() as soon as
+// the context is done, even if fn doesn't watch the context itself. If the context is
+// already done, fn isn't called at all.
+// Example (give up on a slow query when the client disconnects):
+//
+//	users, err := AsyncCtx(c.Context(), func(ctx context.Context) ([]User, error) {
+//		var users []User
+//		err := db.SelectContext(ctx, &users, "SELECT * FROM users")
+//		return users, err
+//	}).Wait()
+func AsyncCtx[T any](ctx context.Context, fn func(ctx context.Context) (T, error)) Promise[T] {
+	return Async(func() (T, error) {
+		if err := ctx.Err(); err != nil {
+			var zero T
+			return zero, err
+		}
+		return Async(func() (T, error) {
+			return fn(ctx)
+		}).WaitContext(ctx)
+	})
+}
+
+// Holds the outcome of a settled promise, see AllSettled.
+type Settled[T any] struct {
+	Value T
+	Err   error
+}
+
+type indexedSettled[T any] struct {
+	index int
+	Settled[T]
+}
+
+// Waits for every promise in its own goroutine and sends the outcomes to the returned
+// channel as they settle. The channel is buffered to fit all of them, so the goroutines
+// never block (and never leak) even if the receiver stops reading early.
+func settle[T any](promises []Promise[T]) <-chan indexedSettled[T] {
+	ch := make(chan indexedSettled[T], len(promises))
+	for i, p := range promises {
+		go func(i int, p Promise[T]) {
+			res, err := p.Wait()
+			ch <- indexedSettled[T]{index: i, Settled: Settled[T]{Value: res, Err: err}}
+		}(i, p)
+	}
+	return ch
+}
+
+// Returns a promise that resolves with the results of all promises, in the same order.
+// It fails as soon as any of the promises fails, without waiting for the others.
+func All[T any](promises ...Promise[T]) Promise[[]T] {
+	return Async(func() ([]T, error) {
+		settled := settle(promises)
+		results := make([]T, len(promises))
+		for range promises {
+			s := <-settled
+			if s.Err != nil {
+				return nil, s.Err
+			}
+			results[s.index] = s.Value
+		}
+		return results, nil
+	})
+}
+
+// Returns a promise that resolves once all promises have settled, with the result and
+// error of each of them in the same order. It never fails.
+func AllSettled[T any](promises ...Promise[T]) Promise[[]Settled[T]] {
+	return Async(func() ([]Settled[T], error) {
+		settled := settle(promises)
+		results := make([]Settled[T], len(promises))
+		for range promises {
+			s := <-settled
+			results[s.index] = s.Settled
+		}
+		return results, nil
+	})
+}
+
+// Returns a promise that settles like the first of the promises to settle,
+// whether it succeeded or failed.
+func Race[T any](promises ...Promise[T]) Promise[T] {
+	return Async(func() (T, error) {
+		if len(promises) == 0 {
+			var zero T
+			return zero, errors.New("race: no promises given")
+		}
+		s := <-settle(promises)
+		return s.Value, s.Err
+	})
+}
+
+// Returns a promise that resolves with the first of the promises to succeed.
+// If all of them fail, it fails with all of their errors joined together.
+func Any[T any](promises ...Promise[T]) Promise[T] {
+	return Async(func() (T, error) {
+		var zero T
+		if len(promises) == 0 {
+			return zero, errors.New("any: no promises given")
+		}
+		settled := settle(promises)
+		errs := make([]error, len(promises))
+		for range promises {
+			s := <-settled
+			if s.Err == nil {
+				return s.Value, nil
+			}
+			errs[s.index] = s.Err
+		}
+		return zero, fmt.Errorf("any: all promises failed: %w", errors.Join(errs...))
+	})
+}
+
+type ParallelOptions struct {
+	CollectErrors bool // Keep going after an error and return all errors joined together. Default: false
+}
+
+// Option for ParallelMap and ForEachLimit to run every item even if some fail,
+// and return all errors joined together instead of only the first one.
+func CollectAllErrors(o *ParallelOptions) {
+	o.CollectErrors = true
+}
+
+// Calls fn for every item with at most `limit` calls running at the same time
+// (no limit if it's 0 or less), and returns the results in the same order as the items.
+//
+// By default it stops on the first error: the context passed to the running calls is cancelled,
+// no new calls are started and the error is returned. With the CollectAllErrors option every item
+// is processed, the results of the successful calls are returned alongside all errors joined together.
+// In both cases cancelling ctx stops starting new calls and its error is returned.
+// Example (load per-user data with at most 4 queries at a time):
+//
+//	stats, err := ParallelMap(c.Context(), users, 4, func(ctx context.Context, user User) (Stats, error) {
+//		return loadStats(ctx, user.ID)
+//	})
+func ParallelMap[T, R any](ctx context.Context, items []T, limit int, fn func(ctx context.Context, item T) (R, error), options ...func(*ParallelOptions)) ([]R, error) {
+	opts := ParallelOptions{}
+	for _, o := range options {
+		o(&opts)
+	}
+	if limit <= 0 || limit > len(items) {
+		limit = len(items)
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	results := make([]R, len(items))
+	errs := make([]error, len(items))
+	var firstErr error
+	var once sync.Once
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+
+	for i, item := range items {
+		// wait for a free slot, unless we've been cancelled in the meantime
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, item T) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res, err := safeCall(func() (R, error) {
+				return fn(ctx, item)
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("item %d: %w", i, err)
+				if !opts.CollectErrors {
+					once.Do(func() {
+						firstErr = errs[i]
+						cancel()
+					})
+				}
+				return
+			}
+			results[i] = res
+		}(i, item)
+	}
+	wg.Wait()
+
+	if opts.CollectErrors {
+		if parent.Err() != nil {
+			errs = append(errs, parent.Err())
+		}
+		return results, errors.Join(errs...)
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if parent.Err() != nil {
+		return nil, parent.Err()
+	}
+	return results, nil
+}
+
+// Same as ParallelMap, for functions that don't return a result.
+func ForEachLimit[T any](ctx context.Context, items []T, limit int, fn func(ctx context.Context, item T) error, options ...func(*ParallelOptions)) error {
+	_, err := ParallelMap(ctx, items, limit, func(ctx context.Context, item T) (struct{}, error) {
+		return struct{}{}, fn(ctx, item)
+	}, options...)
+	return err
+}
@@ -0,0 +1,244 @@
+package common
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Most providers reject messages over 25 MB, and base64 makes attachments a third bigger.
+const DefaultMaxAttachmentsSize = 18 << 20
+
+// A file attached to a Message, or an image embedded in its HTML when ContentID is set.
+// The content is opened and streamed each time the message is written, so a message
+// with big attachments can be sent (or retried) without loading them in memory.
+type Attachment struct {
+	Filename    string                        // Name shown by the email client
+	ContentType string                        // Defaults to the type guessed from the file extension
+	ContentID   string                        // Makes it an inline image, referenced in the HTML with `cid:<ContentID>`
+	Size        int64                         // Size in bytes if known in advance, -1 otherwise. Used to reject big messages early.
+	Open        func() (io.ReadCloser, error) // Opens the content, called every time the message is written
+}
+
+// Attaches the content of a reader. Readers can only be read once, so if the message has
+// to be written again (e.g. sending is retried) use AttachFile or an Attachment with an Open func.
+// Example (attach a CSV export):
+//
+//	var buf bytes.Buffer
+//	csv.NewWriter(&buf).WriteAll(rows)
+//	msg.Attach("users.csv", &buf, "text/csv")
+func (m *Message) Attach(filename string, r io.Reader, contentType string) {
+	m.Attachments = append(m.Attachments, readerAttachment(filename, r, contentType, ""))
+}
+
+// Attaches a file from disk, it's read when the message is written.
+func (m *Message) AttachFile(path string) error {
+	a, err := fileAttachment(path, "")
+	if err != nil {
+		return err
+	}
+	m.Attachments = append(m.Attachments, a)
+	return nil
+}
+
+// Embeds an image in the HTML body and returns its content ID.
+// Reference it in the HTML with `cid:` followed by the ID.
+// Example:
+//
+//	cid := msg.Embed("logo.png", bytes.NewReader(logo), "image/png")
+//	msg.SetHTML(ctx, welcome_email("cid:"+cid))
+func (m *Message) Embed(filename string, r io.Reader, contentType string) string {
+	a := readerAttachment(filename, r, contentType, newContentID(m.From))
+	m.Attachments = append(m.Attachments, a)
+	return a.ContentID
+}
+
+// Same as Embed, for an image file on disk.
+func (m *Message) EmbedFile(path string) (string, error) {
+	a, err := fileAttachment(path, newContentID(m.From))
+	if err != nil {
+		return "", err
+	}
+	m.Attachments = append(m.Attachments, a)
+	return a.ContentID, nil
+}
+
+func readerAttachment(filename string, r io.Reader, contentType string, contentID string) Attachment {
+	var once sync.Once
+	return Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		ContentID:   contentID,
+		Size:        -1,
+		Open: func() (io.ReadCloser, error) {
+			var rc io.ReadCloser
+			once.Do(func() { rc = io.NopCloser(r) })
+			if rc == nil {
+				return nil, fmt.Errorf("the content of %s was already sent, readers can only be read once", filename)
+			}
+			return rc, nil
+		},
+	}
+}
+
+func fileAttachment(path string, contentID string) (Attachment, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("can't attach %s: %v", path, err)
+	}
+	if info.IsDir() {
+		return Attachment{}, fmt.Errorf("can't attach %s: it's a directory", path)
+	}
+	return Attachment{
+		Filename:  filepath.Base(path),
+		ContentID: contentID,
+		Size:      info.Size(),
+		Open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}, nil
+}
+
+// Generates a unique Content-ID in the domain of the sender.
+func newContentID(from string) string {
+	return "img." + newMessageID(from)
+}
+
+func (m *Message) maxAttachmentsSize() int64 {
+	if m.MaxAttachmentsSize > 0 {
+		return m.MaxAttachmentsSize
+	}
+	return DefaultMaxAttachmentsSize
+}
+
+// Checks the attachment headers and the sizes known in advance.
+func (m *Message) checkAttachments() error {
+	var total int64
+	for _, a := range m.Attachments {
+		if a.Open == nil {
+			return fmt.Errorf("attachment %s has no content", a.Filename)
+		}
+		for name, value := range map[string]string{"attachment filename": a.Filename, "attachment Content-Type": a.ContentType, "Content-ID": a.ContentID} {
+			err := checkHeaderValue(name, value)
+			if err != nil {
+				return err
+			}
+		}
+		if a.ContentType != "" {
+			_, _, err := mime.ParseMediaType(a.ContentType)
+			if err != nil {
+				return fmt.Errorf("invalid content type %q for %s: %v", a.ContentType, a.Filename, err)
+			}
+		}
+		if a.ContentID != "" && m.HTML == "" {
+			return fmt.Errorf("inline image %s needs an HTML body", a.Filename)
+		}
+		if a.Size > 0 {
+			total += a.Size
+		}
+	}
+	if total > m.maxAttachmentsSize() {
+		return fmt.Errorf("%w: %d bytes, the limit is %d bytes", ErrAttachmentsTooBig, total, m.maxAttachmentsSize())
+	}
+	return nil
+}
+
+// Returned when sending a message whose attachments are over its MaxAttachmentsSize.
+var ErrAttachmentsTooBig = errors.New("attachments are too big")
+
+// Tracks the size of the attachments written so far, shared by all attachments of a message
+// because the size of readers is only known once they're read.
+type attachmentBudget struct {
+	limit     int64
+	remaining int64
+}
+
+// Returns the attachment as a base64 encoded MIME entity.
+func (a Attachment) entity(budget *attachmentBudget) mimeEntity {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	params["name"] = a.Filename
+
+	disposition := "attachment"
+	header := textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(mediaType, params)},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if a.ContentID != "" {
+		disposition = "inline"
+		header.Set("Content-ID", "<"+a.ContentID+">")
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+
+	return mimeEntity{
+		header: header,
+		write: func(w io.Writer) error {
+			rc, err := a.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			lw := &lineWrapper{w: w}
+			enc := base64.NewEncoder(base64.StdEncoding, lw)
+			// read one byte more than allowed to detect attachments over the limit
+			n, err := io.Copy(enc, io.LimitReader(rc, budget.remaining+1))
+			if err != nil {
+				return fmt.Errorf("failed to read attachment %s: %v", a.Filename, err)
+			}
+			budget.remaining -= n
+			if budget.remaining < 0 {
+				return fmt.Errorf("%w: the limit is %d bytes", ErrAttachmentsTooBig, budget.limit)
+			}
+			err = enc.Close()
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, "\r\n")
+			return err
+		},
+	}
+}
+
+// Splits the base64 output in lines of 76 characters, the maximum allowed by RFC 2045.
+type lineWrapper struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.col == 76 {
+			_, err := io.WriteString(l.w, "\r\n")
+			if err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+		chunk := p[:min(len(p), 76-l.col)]
+		n, err := l.w.Write(chunk)
+		written += n
+		l.col += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
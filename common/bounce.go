@@ -0,0 +1,358 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// This file processes the bounces and complaints we receive, so we stop sending to addresses
+// that don't exist or don't want our emails (which hurts the reputation of the server).
+//
+// Bounces are delivery status notifications (DSN, RFC 3464) and complaints are abuse reports
+// (ARF, RFC 5965): both are multipart/report emails. They're posted raw to /bounces (see the mailing module),
+// or read from a local maildir (BOUNCE_MAILDIR), e.g. the mailbox of the Return-Path address.
+//
+// Addresses that bounced for good or complained are saved in the suppressions table,
+// and the outbox doesn't send to them anymore, until an admin clears them. Anyone can send
+// a report to the Return-Path address, so an address is only suppressed when the report is
+// about a message of the outbox that was sent to it.
+
+const (
+	SuppressionBounce    = "bounce"
+	SuppressionComplaint = "complaint"
+)
+
+// Returned when an outbox message isn't sent because all its recipients are suppressed.
+var ErrSuppressed = errors.New("recipient suppressed")
+
+// Returned when a message given to ProcessBounce isn't a DSN or an ARF report.
+var ErrNotReport = errors.New("not a delivery status notification or an abuse report")
+
+// A bounce or complaint about one recipient, parsed from a report.
+type Bounce struct {
+	Recipient  string
+	Kind       string // SuppressionBounce or SuppressionComplaint
+	Reason     string // Diagnostic of the server, or the type of complaint
+	Permanent  bool   // Whether the address should be suppressed: hard bounces and complaints
+	MessageID  string // Message-ID of the email that bounced, if the report includes it
+	Suppressed bool   // Whether ProcessBounce suppressed the address
+}
+
+// An address the outbox doesn't send to.
+type Suppression struct {
+	Email     string    `db:"email"`
+	Kind      string    `db:"kind"` // SuppressionBounce or SuppressionComplaint
+	Reason    string    `db:"reason"`
+	MessageID string    `db:"message_id"` // Message-ID of the email that bounced, if known
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Parses a DSN or an ARF report and returns the bounces it contains.
+// Returns ErrNotReport for any other message, e.g. an out of office reply or a forwarded report.
+func ParseBounce(r io.Reader) ([]Bounce, error) {
+	parsed, err := ParseMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	// a report attached to another message isn't a report about our messages
+	mediaType, _, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if mediaType != "multipart/report" {
+		return nil, ErrNotReport
+	}
+
+	var status, feedback []byte
+	messageID, originalTo := "", ""
+	for _, a := range parsed.Attachments {
+		switch a.ContentType {
+		case "message/delivery-status", "message/global-delivery-status":
+			status = a.Data
+		case "message/feedback-report":
+			feedback = a.Data
+		case "message/rfc822", "message/global", "text/rfc822-headers":
+			// only the headers matter, and text/rfc822-headers has no blank line after them
+			original, err := mail.ReadMessage(io.MultiReader(bytes.NewReader(a.Data), strings.NewReader("\r\n\r\n")))
+			if err == nil {
+				messageID = strings.Trim(strings.TrimSpace(original.Header.Get("Message-ID")), "<>")
+				originalTo = original.Header.Get("To")
+			}
+		}
+	}
+
+	switch {
+	case status != nil:
+		return parseDeliveryStatus(status, messageID)
+	case feedback != nil:
+		return parseFeedbackReport(feedback, messageID, originalTo)
+	}
+	return nil, ErrNotReport
+}
+
+// Parses the fields of a message/delivery-status part: a block of fields about the message,
+// then a block per recipient. Only the recipients the server gave up on are returned.
+func parseDeliveryStatus(data []byte, messageID string) ([]Bounce, error) {
+	blocks, err := readFieldBlocks(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delivery status: %v", err)
+	}
+	var bounces []Bounce
+	for i, fields := range blocks {
+		if i == 0 || !strings.EqualFold(fields.Get("Action"), "failed") {
+			continue // the per-message fields, or a delayed or delivered recipient
+		}
+		recipient := addressField(fields.Get("Final-Recipient"))
+		if recipient == "" {
+			recipient = addressField(fields.Get("Original-Recipient"))
+		}
+		if recipient == "" {
+			continue
+		}
+		status := strings.TrimSpace(fields.Get("Status"))
+		reason := typedField(fields.Get("Diagnostic-Code"))
+		if reason == "" {
+			reason = "status " + status
+		}
+		bounces = append(bounces, Bounce{
+			Recipient: recipient,
+			Kind:      SuppressionBounce,
+			Reason:    reason,
+			// 4.x.x means the server gave up on a temporary error, e.g. a full mailbox
+			Permanent: strings.HasPrefix(status, "5"),
+			MessageID: messageID,
+		})
+	}
+	if len(bounces) == 0 && len(blocks) < 2 {
+		return nil, errors.New("invalid delivery status: no recipient")
+	}
+	return bounces, nil
+}
+
+// Parses the fields of a message/feedback-report part. Providers often remove the recipient
+// from the report, then the To header of the original message is used.
+func parseFeedbackReport(data []byte, messageID string, originalTo string) ([]Bounce, error) {
+	blocks, err := readFieldBlocks(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feedback report: %v", err)
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("invalid feedback report: no fields")
+	}
+	fields := blocks[0]
+	recipients := fields.Values("Original-Rcpt-To")
+	if len(recipients) == 0 && originalTo != "" {
+		addresses, err := mail.ParseAddressList(originalTo)
+		if err == nil {
+			for _, a := range addresses {
+				recipients = append(recipients, a.Address)
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("invalid feedback report: no recipient")
+	}
+
+	feedbackType := strings.TrimSpace(fields.Get("Feedback-Type"))
+	var bounces []Bounce
+	for _, recipient := range recipients {
+		bounces = append(bounces, Bounce{
+			Recipient: addressField(recipient),
+			Kind:      SuppressionComplaint,
+			Reason:    "marked as " + TernaryIf(feedbackType != "", feedbackType, "abuse"),
+			Permanent: true,
+			MessageID: messageID,
+		})
+	}
+	return bounces, nil
+}
+
+// Reads blocks of header-like fields separated by blank lines.
+func readFieldBlocks(data []byte) ([]textproto.MIMEHeader, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	var blocks []textproto.MIMEHeader
+	for {
+		fields, err := r.ReadMIMEHeader()
+		if len(fields) > 0 {
+			blocks = append(blocks, fields)
+		}
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return blocks, err
+		}
+	}
+}
+
+// Returns the value of a typed field like `smtp; 550 5.1.1 User unknown`, without its type.
+func typedField(value string) string {
+	if _, v, ok := strings.Cut(value, ";"); ok {
+		value = v
+	}
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// Returns the address of a field like `rfc822; jane@example.com` or `<jane@example.com>`.
+func addressField(value string) string {
+	value = strings.Trim(typedField(value), "<>")
+	if addr, err := mail.ParseAddress(value); err == nil {
+		return strings.ToLower(addr.Address)
+	}
+	return strings.ToLower(value)
+}
+
+// Parses a report and suppresses the addresses of its permanent bounces and complaints, when the
+// original message is in the outbox and was sent to them. Other bounces are logged and ignored.
+// Returns the bounces it contains, see ParseBounce.
+func ProcessBounce(r io.Reader) ([]Bounce, error) {
+	bounces, err := ParseBounce(r)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range bounces {
+		if !b.Permanent {
+			continue
+		}
+		sent, err := wasSentTo(b.MessageID, b.Recipient)
+		if err != nil {
+			return bounces, err
+		}
+		if !sent {
+			log.Printf("Ignored %s for %s: no message <%s> sent to it in the outbox", b.Kind, b.Recipient, b.MessageID)
+			continue
+		}
+		err = SuppressAddress(Suppression{Email: b.Recipient, Kind: b.Kind, Reason: b.Reason, MessageID: b.MessageID})
+		if err != nil {
+			return bounces, err
+		}
+		bounces[i].Suppressed = true
+	}
+	return bounces, nil
+}
+
+// Returns whether the outbox has a message with this Message-ID sent to the address.
+func wasSentTo(messageID string, address string) (bool, error) {
+	if messageID == "" {
+		return false, nil
+	}
+	var count int
+	err := MailDb.Get(&count, `SELECT COUNT(*) FROM outbox WHERE message_id = ? AND LOWER(', ' || recipients || ', ') LIKE ? ESCAPE '\'`,
+		messageID, "%, "+escapeLike(strings.ToLower(address))+", %")
+	if err != nil {
+		return false, fmt.Errorf("failed to find the message of the bounce: %v", err)
+	}
+	return count > 0, nil
+}
+
+// Stops sending emails to the address. Suppressing it again replaces the reason.
+func SuppressAddress(s Suppression) error {
+	_, err := MailDb.Exec(`INSERT INTO suppressions (email, kind, reason, message_id, created_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(email) DO UPDATE SET kind = excluded.kind, reason = excluded.reason, message_id = excluded.message_id, created_at = excluded.created_at`,
+		strings.ToLower(s.Email), s.Kind, s.Reason, s.MessageID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to suppress %s: %v", s.Email, err)
+	}
+	return nil
+}
+
+// Sends emails to the address again.
+func RemoveSuppression(email string) error {
+	_, err := MailDb.Exec(`DELETE FROM suppressions WHERE email = ?`, strings.ToLower(email))
+	return err
+}
+
+// Returns the suppressed addresses matching the query (all of them if it's empty), newest first.
+func SearchSuppressions(query string) ([]Suppression, error) {
+	var suppressions []Suppression
+	err := MailDb.Select(&suppressions, `SELECT * FROM suppressions WHERE email LIKE ? ESCAPE '\' OR reason LIKE ? ESCAPE '\'
+	ORDER BY created_at DESC LIMIT 500`, "%"+escapeLike(query)+"%", "%"+escapeLike(query)+"%")
+	return suppressions, err
+}
+
+// Returns the suppressions of the given addresses, for the ones that are suppressed.
+func getSuppressions(addresses []string) ([]Suppression, error) {
+	var suppressions []Suppression
+	for _, addr := range addresses {
+		var s []Suppression
+		err := MailDb.Select(&s, `SELECT * FROM suppressions WHERE email = ?`, strings.ToLower(addr))
+		if err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, s...)
+	}
+	return suppressions, nil
+}
+
+// Starts reading the bounces delivered to BOUNCE_MAILDIR in the background, if it's set.
+// Call it once when the app starts. Processed messages are moved from new/ to cur/, like a mail client does,
+// or deleted if they can't be moved.
+func StartBounceMaildir() {
+	if Env.BOUNCE_MAILDIR == "" {
+		return
+	}
+	go func() {
+		for {
+			processBounceMaildir(Env.BOUNCE_MAILDIR)
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+func processBounceMaildir(dir string) {
+	files, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		log.Printf("Error reading bounce maildir: %v", err)
+		return
+	}
+	err = os.MkdirAll(filepath.Join(dir, "cur"), 0o700)
+	if err != nil {
+		log.Printf("Error creating cur in bounce maildir: %v", err)
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, "new", file.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Error reading bounce %s: %v", file.Name(), err)
+			continue
+		}
+		bounces, err := ProcessBounce(f)
+		f.Close()
+		switch {
+		case errors.Is(err, ErrNotReport):
+			// replies and out of office messages end up here too, they're only marked as read
+		case err != nil && bounces != nil:
+			// the report is valid but the suppressions couldn't be saved, try again later
+			log.Printf("Error processing bounce %s: %v", file.Name(), err)
+			continue
+		case err != nil:
+			log.Printf("Error processing bounce %s: %v", file.Name(), err)
+		default:
+			for _, b := range bounces {
+				log.Printf("Processed %s for %s: %s", b.Kind, b.Recipient, b.Reason)
+			}
+		}
+
+		// the ":2,S" suffix marks the message as seen
+		err = os.Rename(path, filepath.Join(dir, "cur", file.Name()+":2,S"))
+		if err != nil {
+			// left in new/, it would be processed again every minute
+			log.Printf("Error moving bounce %s to cur, deleting it: %v", file.Name(), err)
+			err = os.Remove(path)
+			if err != nil {
+				log.Printf("Error deleting bounce %s: %v", file.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Reports as sent by mail servers, with LF line endings for readability (see crlf).
+const (
+	testDSN = `From: MAILER-DAEMON@mx.example.com
+To: bounces@example.com
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="BB"
+
+--BB
+Content-Type: text/plain
+
+I am sorry to inform you...
+
+--BB
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+Arrival-Date: Mon, 19 Oct 2026 10:00:00 +0000
+
+Final-Recipient: rfc822; Bob@Example.org
+Original-Recipient: rfc822;bob@example.org
+Action: failed
+Status: 5.1.1
+Diagnostic-Code: smtp; 550 5.1.1 <bob@example.org>: Recipient address
+    rejected: User unknown
+
+Final-Recipient: rfc822; full@example.org
+Action: failed
+Status: 4.2.2
+Diagnostic-Code: smtp; 452 4.2.2 Mailbox full
+
+Final-Recipient: rfc822; ok@example.org
+Action: delivered
+Status: 2.0.0
+
+--BB
+Content-Type: text/rfc822-headers
+
+From: app@example.com
+To: bob@example.org
+Subject: Password Reset
+Message-ID: <123.abc@example.com>
+
+--BB--
+`
+	testARF = `From: abuse@isp.example
+To: fbl@example.com
+Subject: FW: spam
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=feedback-report; boundary="CC"
+
+--CC
+Content-Type: text/plain
+
+This is an email abuse report
+
+--CC
+Content-Type: message/feedback-report
+
+Feedback-Type: abuse
+User-Agent: SomeGenerator/1.0
+Version: 1
+%s
+--CC
+Content-Type: message/rfc822
+
+From: app@example.com
+To: Carol <carol@example.net>
+Message-ID: <456.def@example.com>
+Subject: hi
+
+body
+
+--CC--
+`
+)
+
+// Converts the line endings of a test message to CRLF, as on the wire.
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// Returns a DSN about one recipient of a message.
+func testBounceReport(messageID string, recipient string, status string) string {
+	return crlf(fmt.Sprintf(`From: MAILER-DAEMON@mx.example.com
+To: bounces@example.com
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="BB"
+
+--BB
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+
+Final-Recipient: rfc822; %s
+Action: failed
+Status: %s
+
+--BB
+Content-Type: message/rfc822
+
+From: app@example.com
+To: %s
+Message-ID: <%s>
+Subject: Test
+
+Hello
+--BB--
+`, recipient, status, recipient, messageID))
+}
+
+func TestParseBounce(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    []Bounce
+		wantErr error // Nil to only check that it fails when want is empty
+	}{
+		{
+			name:    "delivery status notification",
+			message: crlf(testDSN),
+			want: []Bounce{
+				{Recipient: "bob@example.org", Kind: SuppressionBounce, Permanent: true, MessageID: "123.abc@example.com",
+					Reason: "550 5.1.1 <bob@example.org>: Recipient address rejected: User unknown"},
+				{Recipient: "full@example.org", Kind: SuppressionBounce, Permanent: false, MessageID: "123.abc@example.com",
+					Reason: "452 4.2.2 Mailbox full"},
+			},
+		},
+		{
+			name:    "delivery status without diagnostic",
+			message: testBounceReport("789.ghi@example.com", "dave@example.org", "5.0.0"),
+			want: []Bounce{
+				{Recipient: "dave@example.org", Kind: SuppressionBounce, Permanent: true, MessageID: "789.ghi@example.com", Reason: "status 5.0.0"},
+			},
+		},
+		{
+			name:    "abuse report with the recipient of the original message",
+			message: crlf(fmt.Sprintf(testARF, "")),
+			want: []Bounce{
+				{Recipient: "carol@example.net", Kind: SuppressionComplaint, Permanent: true, MessageID: "456.def@example.com", Reason: "marked as abuse"},
+			},
+		},
+		{
+			name:    "abuse report with Original-Rcpt-To",
+			message: crlf(fmt.Sprintf(testARF, "Original-Rcpt-To: <Erin@Example.net>\n")),
+			want: []Bounce{
+				{Recipient: "erin@example.net", Kind: SuppressionComplaint, Permanent: true, MessageID: "456.def@example.com", Reason: "marked as abuse"},
+			},
+		},
+		{
+			name:    "out of office reply",
+			message: crlf("From: x@example.org\nTo: bounces@example.com\nSubject: Out of office\n\nI am away\n"),
+			wantErr: ErrNotReport,
+		},
+		{
+			name: "forwarded report",
+			message: crlf("From: someone@example.net\nTo: bounces@example.com\nSubject: Fwd\nMIME-Version: 1.0\n" +
+				"Content-Type: multipart/mixed; boundary=\"FW\"\n\n--FW\nContent-Type: text/plain\n\nlook\n" +
+				"--FW\nContent-Type: message/rfc822\n\n" + testDSN + "\n--FW--\n"),
+			wantErr: ErrNotReport,
+		},
+		{
+			name: "report without status",
+			message: crlf("From: MAILER-DAEMON@mx.example.com\nMIME-Version: 1.0\n" +
+				"Content-Type: multipart/report; report-type=delivery-status; boundary=\"BB\"\n\n" +
+				"--BB\nContent-Type: text/plain\n\nsorry\n--BB--\n"),
+			wantErr: ErrNotReport,
+		},
+		{
+			name: "delivery status without recipient",
+			message: crlf("From: MAILER-DAEMON@mx.example.com\nMIME-Version: 1.0\n" +
+				"Content-Type: multipart/report; report-type=delivery-status; boundary=\"BB\"\n\n" +
+				"--BB\nContent-Type: message/delivery-status\n\nReporting-MTA: dns; mx.example.com\n--BB--\n"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bounces, err := ParseBounce(strings.NewReader(tt.message))
+			if len(tt.want) == 0 {
+				if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+					t.Fatalf("got bounces %+v and error %v, want error %v", bounces, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(bounces, tt.want) {
+				t.Errorf("got bounces\n%+v\nwant\n%+v", bounces, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessBounce(t *testing.T) {
+	tests := []struct {
+		name           string
+		sentID         string // Message-ID of the message in the outbox
+		sentTo         string // Its recipients
+		reportID       string // Message-ID in the report
+		recipient      string
+		status         string
+		wantSuppressed bool
+	}{
+		{
+			name:   "hard bounce of a sent message",
+			sentID: "hard@example.com", sentTo: "hard@example.org",
+			reportID: "hard@example.com", recipient: "hard@example.org", status: "5.1.1",
+			wantSuppressed: true,
+		},
+		{
+			name:   "hard bounce of one of the recipients",
+			sentID: "many@example.com", sentTo: "first@example.org, Second@Example.org",
+			reportID: "many@example.com", recipient: "second@example.org", status: "5.1.1",
+			wantSuppressed: true,
+		},
+		{
+			name:   "soft bounce",
+			sentID: "soft@example.com", sentTo: "soft@example.org",
+			reportID: "soft@example.com", recipient: "soft@example.org", status: "4.2.2",
+		},
+		{
+			name:   "message not in the outbox",
+			sentID: "real@example.com", sentTo: "forged@example.org",
+			reportID: "forged@example.com", recipient: "forged@example.org", status: "5.1.1",
+		},
+		{
+			name:   "message not sent to the recipient",
+			sentID: "other@example.com", sentTo: "other@example.org",
+			reportID: "other@example.com", recipient: "victim@example.org", status: "5.1.1",
+		},
+		{
+			name:   "recipient with wildcards",
+			sentID: "wildcard@example.com", sentTo: "wildxcard@example.org",
+			reportID: "wildcard@example.com", recipient: "wild_card@example.org", status: "5.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addTestOutboxEntry(t, "placeholder@example.com", "message_id = ?, recipients = ?, status = ?", tt.sentID, tt.sentTo, OutboxSent)
+
+			bounces, err := ProcessBounce(strings.NewReader(testBounceReport(tt.reportID, tt.recipient, tt.status)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(bounces) != 1 || bounces[0].Suppressed != tt.wantSuppressed {
+				t.Fatalf("got bounces %+v, want suppressed %v", bounces, tt.wantSuppressed)
+			}
+			suppressions, err := getSuppressions([]string{tt.recipient})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if suppressed := len(suppressions) > 0; suppressed != tt.wantSuppressed {
+				t.Errorf("got %s suppressed %v, want %v", tt.recipient, suppressed, tt.wantSuppressed)
+			}
+		})
+	}
+}
+
+func TestClaimOutboxEntrySuppressions(t *testing.T) {
+	useTestRateLimits(t, RateLimits{})
+	err := SuppressAddress(Suppression{Email: "Gone@Example.org", Kind: SuppressionBounce, Reason: "550 5.1.1 User unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SuppressAddress(Suppression{Email: "angry@example.org", Kind: SuppressionComplaint, Reason: "marked as abuse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		recipients     string
+		wantClaimed    bool
+		wantRecipients string // Recipients the claimed message is sent to
+		wantError      string // Last error of a message that isn't claimed
+	}{
+		{name: "no suppressed recipient", recipients: "welcome@example.org", wantClaimed: true, wantRecipients: "welcome@example.org"},
+		{name: "suppressed recipient", recipients: "gone@example.org", wantError: "Suppressed: gone@example.org (bounce: 550 5.1.1 User unknown)"},
+		{name: "compared without case", recipients: "GONE@example.org", wantError: "Suppressed: gone@example.org (bounce: 550 5.1.1 User unknown)"},
+		{
+			name:       "every recipient suppressed",
+			recipients: "gone@example.org, angry@example.org",
+			wantError:  "Suppressed: gone@example.org (bounce: 550 5.1.1 User unknown), angry@example.org (complaint: marked as abuse)",
+		},
+		{
+			name:           "some recipients suppressed",
+			recipients:     "gone@example.org, welcome@example.org, angry@example.org",
+			wantClaimed:    true,
+			wantRecipients: "welcome@example.org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := addTestOutboxEntry(t, "placeholder@example.com", "recipients = ?", tt.recipients)
+
+			entry, claimed, err := claimOutboxEntry(id)
+			if claimed != tt.wantClaimed {
+				t.Fatalf("got claimed %v (error %v), want %v", claimed, err, tt.wantClaimed)
+			}
+			if claimed {
+				if err != nil || entry.Recipients != tt.wantRecipients {
+					t.Errorf("got recipients %q (error %v), want %q", entry.Recipients, err, tt.wantRecipients)
+				}
+				// the delivery log keeps every recipient
+				if saved := getTestOutboxEntry(t, id); saved.Recipients != tt.recipients {
+					t.Errorf("got saved recipients %q, want %q", saved.Recipients, tt.recipients)
+				}
+				return
+			}
+			if !errors.Is(err, ErrSuppressed) {
+				t.Errorf("got error %v, want an ErrSuppressed error", err)
+			}
+			saved := getTestOutboxEntry(t, id)
+			if saved.Status != OutboxSuppressed || saved.LastError != tt.wantError {
+				t.Errorf("got status %s and last error %q, want %s and %q", saved.Status, saved.LastError, OutboxSuppressed, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestProcessBounceMaildir(t *testing.T) {
+	addTestOutboxEntry(t, "placeholder@example.com", "message_id = ?, recipients = ?, status = ?", "maildir@example.com", "maildir@example.org", OutboxSent)
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, "new"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]string{
+		"1.bounce": testBounceReport("maildir@example.com", "maildir@example.org", "5.1.1"),
+		"2.reply":  crlf("From: x@example.org\nTo: bounces@example.com\nSubject: Out of office\n\nI am away\n"),
+	}
+	for name, message := range messages {
+		err = os.WriteFile(filepath.Join(dir, "new", name), []byte(message), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cur/ doesn't exist yet, it's created
+	processBounceMaildir(dir)
+
+	for name := range messages {
+		if _, err := os.Stat(filepath.Join(dir, "new", name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s is still in new/ (error %v)", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "cur", name+":2,S")); err != nil {
+			t.Errorf("%s wasn't moved to cur/: %v", name, err)
+		}
+	}
+	suppressions, err := getSuppressions([]string{"maildir@example.org"})
+	if err != nil || len(suppressions) != 1 {
+		t.Errorf("got suppressions %+v (error %v), want maildir@example.org suppressed", suppressions, err)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,11 +21,24 @@ func CacheKey(key string, args ...interface{}) string {
 	return result
 }
 
+// Returns the prefix of a key built with CacheKey (i.e. the first segment before ":").
+func CachePrefix(key string) string {
+	prefix, _, _ := strings.Cut(key, ":")
+	return prefix
+}
+
 type ICacheStore interface {
 	Get(key string) ([]byte, error)
 	Set(key string, val []byte, exp time.Duration) error
 }
 
+// Implemented by cache stores that can report statistics and be flushed per key prefix.
+// The admin cache inspector lists every registered store that implements it.
+type ICacheInspector interface {
+	Stats() map[string]CacheStats // Statistics grouped by key prefix.
+	Flush(prefix string) error    // Deletes every key with the given prefix.
+}
+
 func Remember[T any](store ICacheStore, key string, duration time.Duration, fn func() (T, error)) (T, error) {
 	cached, err := store.Get(key)
 	if err == nil && cached != nil && len(cached) > 0 {
@@ -46,6 +62,133 @@ func Remember[T any](store ICacheStore, key string, duration time.Duration, fn f
 	return result, nil
 }
 
+var cacheStores = map[string]ICacheInspector{}
+var cacheStoresMu sync.RWMutex
+
+// Registers a cache store under a name so it shows up in the admin cache inspector.
+// Registering a store under an existing name replaces it.
+// Example:
+//
+//	var sessionsCache = common.NewCacheStore()
+//
+//	func AddRoutes(app *fiber.App) {
+//		common.RegisterCacheStore("sessions", sessionsCache)
+//	}
+func RegisterCacheStore(name string, store ICacheInspector) {
+	cacheStoresMu.Lock()
+	defer cacheStoresMu.Unlock()
+	cacheStores[name] = store
+}
+
+// Returns the names of the registered cache stores, sorted alphabetically.
+func CacheStoreNames() []string {
+	cacheStoresMu.RLock()
+	defer cacheStoresMu.RUnlock()
+	names := make([]string, 0, len(cacheStores))
+	for name := range cacheStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the registered cache store with the given name.
+func GetCacheStore(name string) (ICacheInspector, error) {
+	cacheStoresMu.RLock()
+	defer cacheStoresMu.RUnlock()
+	store, ok := cacheStores[name]
+	if !ok {
+		return nil, fmt.Errorf("cache store %s not found", name)
+	}
+	return store, nil
+}
+
+// Describes the statistics of a cache store for a single key prefix.
+type CacheStats struct {
+	Prefix      string // The key prefix (see CachePrefix).
+	Hits        int64  // Number of reads that found a fresh value.
+	Misses      int64  // Number of reads that found nothing (including expired values).
+	Deletes     int64  // Number of keys removed on purpose, by Delete or Flush.
+	Expirations int64  // Number of keys removed because they expired.
+	Keys        int    // Number of keys currently stored.
+	Bytes       int    // Size of the values currently stored.
+}
+
+// Returns the ratio of hits to reads, between 0 and 1.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Returns the given stats sorted by prefix.
+func SortedCacheStats(stats map[string]CacheStats) []CacheStats {
+	sorted := make([]CacheStats, 0, len(stats))
+	for _, s := range stats {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Prefix < sorted[j].Prefix
+	})
+	return sorted
+}
+
+// Keeps hit, miss, delete and expiration counters per key prefix.
+// It's safe for concurrent use and meant to be used inside cache stores,
+// so persistent stores can report the same statistics as CacheStore.
+type CacheStatsTracker struct {
+	mu    sync.Mutex
+	stats map[string]*CacheStats
+}
+
+// Records a read that found a fresh value.
+func (t *CacheStatsTracker) Hit(key string) {
+	t.record(key, func(s *CacheStats) { s.Hits++ })
+}
+
+// Records a read that found nothing.
+func (t *CacheStatsTracker) Miss(key string) {
+	t.record(key, func(s *CacheStats) { s.Misses++ })
+}
+
+// Records a key removed on purpose (i.e. Delete or Flush).
+func (t *CacheStatsTracker) Delete(key string) {
+	t.record(key, func(s *CacheStats) { s.Deletes++ })
+}
+
+// Records a key removed because it expired.
+func (t *CacheStatsTracker) Expire(key string) {
+	t.record(key, func(s *CacheStats) { s.Expirations++ })
+}
+
+func (t *CacheStatsTracker) record(key string, fn func(s *CacheStats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stats == nil {
+		t.stats = make(map[string]*CacheStats)
+	}
+	prefix := CachePrefix(key)
+	s, ok := t.stats[prefix]
+	if !ok {
+		s = &CacheStats{Prefix: prefix}
+		t.stats[prefix] = s
+	}
+	fn(s)
+}
+
+// Returns a copy of the counters grouped by prefix. Keys and Bytes are left
+// empty since only the store knows what it currently holds.
+func (t *CacheStatsTracker) Snapshot() map[string]CacheStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[string]CacheStats, len(t.stats))
+	for prefix, s := range t.stats {
+		snapshot[prefix] = *s
+	}
+	return snapshot
+}
+
 func NewCacheStore() *CacheStore {
 	return &CacheStore{
 		kV:       make(map[string][]byte),
@@ -54,26 +197,38 @@ func NewCacheStore() *CacheStore {
 }
 
 type CacheStore struct {
+	stats    CacheStatsTracker
+	mu       sync.Mutex
 	kV       map[string][]byte
 	expiries map[string]time.Time
 }
 
 func (c *CacheStore) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	val, ok := c.kV[key]
 	if !ok {
+		c.stats.Miss(key)
 		return nil, errors.New("key not found")
 	}
 
 	expiry, exists := c.expiries[key]
 	if exists && time.Now().After(expiry) {
-		c.Delete(key)
+		c.delete(key)
+		c.stats.Expire(key)
+		c.stats.Miss(key)
 		return nil, errors.New("key expired")
 	}
 
+	c.stats.Hit(key)
 	return val, nil
 }
 
 func (c *CacheStore) Set(key string, val []byte, exp time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.kV[key] = val
 	if exp > 0 {
 		c.expiries[key] = time.Now().Add(exp)
@@ -84,7 +239,50 @@ func (c *CacheStore) Set(key string, val []byte, exp time.Duration) error {
 }
 
 func (c *CacheStore) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.kV[key]; ok {
+		c.delete(key)
+		c.stats.Delete(key)
+	}
+	return nil
+}
+
+// Deletes every key with the given prefix.
+func (c *CacheStore) Flush(prefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.kV {
+		if CachePrefix(key) == prefix {
+			c.delete(key)
+			c.stats.Delete(key)
+		}
+	}
+	return nil
+}
+
+// Returns the statistics of the store grouped by key prefix.
+// Expired keys that haven't been read yet are still counted in Keys and Bytes.
+func (c *CacheStore) Stats() map[string]CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats.Snapshot()
+	for key, val := range c.kV {
+		prefix := CachePrefix(key)
+		s := stats[prefix]
+		s.Prefix = prefix
+		s.Keys++
+		s.Bytes += len(val)
+		stats[prefix] = s
+	}
+	return stats
+}
+
+// Removes a key from the store. The caller must hold the lock.
+func (c *CacheStore) delete(key string) {
 	delete(c.kV, key)
 	delete(c.expiries, key)
-	return nil
 }
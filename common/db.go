@@ -0,0 +1,29 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Adds a column to an existing table if it's not there yet, since SQLite doesn't
+// support `ADD COLUMN IF NOT EXISTS`. Use it to migrate tables created by older versions
+// of the app, right after their `CREATE TABLE IF NOT EXISTS` statement.
+// Example:
+//
+//	err = AddColumnIfMissing(MailDb, "mailer_config", "tls_mode", "TEXT NOT NULL DEFAULT 'starttls'")
+func AddColumnIfMissing(db *sqlx.DB, table string, column string, definition string) error {
+	var count int
+	err := db.Get(&count, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column)
+	if err != nil {
+		return fmt.Errorf("failed to get columns of %s: %v", table, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s to %s: %v", column, table, err)
+	}
+	return nil
+}
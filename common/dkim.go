@@ -0,0 +1,388 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This file signs outgoing messages with DKIM (RFC 6376), so receivers can check they really come
+// from the domain and weren't modified on the way. Unsigned mail from self-hosted servers often ends up in spam.
+//
+// The key pair is generated in the admin page and saved in the dkim_config table, the private key
+// encrypted (see secrets.go). The public key has to be published in a DNS TXT record at
+// `<selector>._domainkey.<domain>`, the admin page shows the record.
+//
+// Messages are signed when they're written (Message.WriteTo), with relaxed/relaxed canonicalization,
+// using RSA-SHA256 or Ed25519-SHA256 (RFC 8463).
+
+const (
+	DKIMAlgorithmRSA     = "rsa-sha256"
+	DKIMAlgorithmEd25519 = "ed25519-sha256"
+)
+
+var DKIMAlgorithms = []string{DKIMAlgorithmRSA, DKIMAlgorithmEd25519}
+
+// Headers signed when they're present. From is signed once more than it appears, so a
+// second From header can't be added to a signed message.
+var dkimSignedHeaders = []string{"From", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// The DKIM settings saved in the mail database.
+type DKIMConfig struct {
+	Enabled    bool      `db:"enabled"`
+	Domain     string    `db:"domain"`      // Signing domain (d=), usually the domain of the From address
+	Selector   string    `db:"selector"`    // Selects the key among the ones published for the domain (s=)
+	Algorithm  string    `db:"algorithm"`   // One of DKIMAlgorithms
+	PrivateKey string    `db:"private_key"` // PEM encoded PKCS #8 key, encrypted in the database
+	CreatedAt  time.Time `db:"created_at"`  // When the key was generated
+}
+
+// Signs messages with a DKIM key.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+}
+
+var (
+	dkimSigner   atomic.Pointer[DKIMSigner]
+	dkimConfigMu sync.Mutex
+)
+
+var dkimSelectorRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// Generates a private key for the algorithm and returns it PEM encoded.
+// RSA keys are 2048 bits, the size most DNS providers and receivers support.
+func GenerateDKIMKey(algorithm string) (string, error) {
+	var key any
+	var err error
+	switch algorithm {
+	case DKIMAlgorithmRSA:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case DKIMAlgorithmEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", fmt.Errorf("unknown DKIM algorithm %q", algorithm)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to generate DKIM key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// Checks the settings and returns the signer they describe.
+func (c *DKIMConfig) signer() (*DKIMSigner, error) {
+	if len(c.Domain) > 253 || !hostnameRegex.MatchString(c.Domain) || !strings.Contains(c.Domain, ".") {
+		return nil, fmt.Errorf("%q is not a valid domain", c.Domain)
+	}
+	if len(c.Selector) > 63 || !dkimSelectorRegex.MatchString(c.Selector) {
+		return nil, fmt.Errorf("%q is not a valid selector, use letters, digits and dashes", c.Selector)
+	}
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return nil, errors.New("no DKIM key, generate one first")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DKIM key: %v", err)
+	}
+	signer := &DKIMSigner{Domain: c.Domain, Selector: c.Selector}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if c.Algorithm != DKIMAlgorithmRSA {
+			return nil, errors.New("the DKIM key is an RSA key")
+		}
+		signer.Key = key
+	case ed25519.PrivateKey:
+		if c.Algorithm != DKIMAlgorithmEd25519 {
+			return nil, errors.New("the DKIM key is an Ed25519 key")
+		}
+		signer.Key = key
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+	return signer, nil
+}
+
+// Returns the name and the value of the DNS TXT record to publish for the settings.
+func (c *DKIMConfig) DNSRecord() (string, string, error) {
+	signer, err := c.signer()
+	if err != nil {
+		return "", "", err
+	}
+	record, err := signer.DNSRecord()
+	return signer.DNSName(), record, err
+}
+
+// Returns the DKIM settings with the private key decrypted, or nil if DKIM was never set up.
+func GetDKIMConfig() (*DKIMConfig, error) {
+	var config DKIMConfig
+	err := MailDb.Get(&config, `SELECT enabled, domain, selector, algorithm, private_key, created_at FROM dkim_config`)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.PrivateKey, err = DecryptSecret(config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt DKIM key: %v", err)
+	}
+	return &config, nil
+}
+
+// Validates and saves the DKIM settings, then signs the next messages with them
+// (or stops signing if they're disabled).
+// Example:
+//
+//	key, err := GenerateDKIMKey(DKIMAlgorithmEd25519)
+//	err = SaveDKIMConfig(&DKIMConfig{Enabled: true, Domain: "example.com", Selector: "mail", Algorithm: DKIMAlgorithmEd25519, PrivateKey: key})
+func SaveDKIMConfig(config *DKIMConfig) error {
+	signer, err := config.signer()
+	if err != nil {
+		return err
+	}
+	if config.CreatedAt.IsZero() {
+		config.CreatedAt = time.Now().UTC()
+	}
+
+	dkimConfigMu.Lock()
+	defer dkimConfigMu.Unlock()
+
+	privateKey, err := EncryptSecret(config.PrivateKey)
+	if err != nil {
+		return err
+	}
+	_, err = MailDb.Exec(`
+	INSERT INTO dkim_config (id, enabled, domain, selector, algorithm, private_key, created_at) VALUES (1, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+	enabled = excluded.enabled,
+	domain = excluded.domain,
+	selector = excluded.selector,
+	algorithm = excluded.algorithm,
+	private_key = excluded.private_key,
+	created_at = excluded.created_at`,
+		config.Enabled, config.Domain, config.Selector, config.Algorithm, privateKey, config.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save DKIM settings: %v", err)
+	}
+
+	if config.Enabled {
+		// the strings can come from a fiber request, which reuses its buffer after the request
+		signer.Domain, signer.Selector = strings.Clone(signer.Domain), strings.Clone(signer.Selector)
+		dkimSigner.Store(signer)
+	} else {
+		dkimSigner.Store(nil)
+	}
+	return nil
+}
+
+// Loads the DKIM settings from the database and signs the next messages with them if they're enabled.
+func ReloadDKIM() error {
+	dkimConfigMu.Lock()
+	defer dkimConfigMu.Unlock()
+
+	config, err := GetDKIMConfig()
+	if err != nil {
+		return err
+	}
+	if config == nil || !config.Enabled {
+		dkimSigner.Store(nil)
+		return nil
+	}
+	signer, err := config.signer()
+	if err != nil {
+		return err
+	}
+	dkimSigner.Store(signer)
+	return nil
+}
+
+// Returns the algorithm of the signature, e.g. rsa-sha256.
+func (s *DKIMSigner) Algorithm() string {
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		return DKIMAlgorithmEd25519
+	}
+	return DKIMAlgorithmRSA
+}
+
+// Returns the name of the DNS TXT record holding the public key, e.g. `mail._domainkey.example.com`.
+func (s *DKIMSigner) DNSName() string {
+	return s.Selector + "._domainkey." + s.Domain
+}
+
+// Returns the value of the DNS TXT record holding the public key, e.g. `v=DKIM1; k=ed25519; p=...`.
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	switch key := s.Key.(type) {
+	case ed25519.PrivateKey:
+		// Ed25519 keys are published raw, not in a SubjectPublicKeyInfo (RFC 8463)
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+	case *rsa.PrivateKey:
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	}
+	return "", fmt.Errorf("unsupported DKIM key type %T", s.Key)
+}
+
+// Signs a message in the RFC 5322 format with CRLF line endings and returns
+// the DKIM-Signature header to add at its top, with its line ending.
+func (s *DKIMSigner) Sign(msg []byte) (string, error) {
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = msg, nil
+	}
+	fields := splitHeaderFields(string(header) + "\r\n")
+
+	bodyHash := sha256.Sum256(canonicalBodyRelaxed(body))
+
+	// pick the fields to sign from the bottom up, as verifiers do
+	var names []string
+	var signed strings.Builder
+	used := map[int]bool{}
+	for _, name := range dkimSignedHeaders {
+		count := 0
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fields[i].name, name) {
+				continue
+			}
+			used[i] = true
+			signed.WriteString(canonicalHeaderRelaxed(fields[i].name, fields[i].value) + "\r\n")
+			names = append(names, strings.ToLower(name))
+			count++
+		}
+		if name == "From" && count > 0 {
+			names = append(names, "from")
+		}
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + s.Algorithm(),
+		"c=relaxed/relaxed",
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"t=" + strconv.FormatInt(time.Now().Unix(), 10),
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	value := strings.Join(tags, "; ")
+	// the signature covers the DKIM-Signature header itself, with an empty b= and no line ending
+	signed.WriteString(canonicalHeaderRelaxed("DKIM-Signature", value))
+	hash := sha256.Sum256([]byte(signed.String()))
+
+	var signature []byte
+	var err error
+	switch key := s.Key.(type) {
+	case ed25519.PrivateKey:
+		// Ed25519-SHA256 signs the hash, not the data itself (RFC 8463)
+		signature = ed25519.Sign(key, hash[:])
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	default:
+		err = fmt.Errorf("unsupported DKIM key type %T", s.Key)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign message: %v", err)
+	}
+
+	// spaces are allowed in b=, they let writeHeader fold the long signature
+	b := base64.StdEncoding.EncodeToString(signature)
+	var chunks []string
+	for len(b) > 64 {
+		chunks, b = append(chunks, b[:64]), b[64:]
+	}
+	chunks = append(chunks, b)
+
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	writeHeader(w, "DKIM-Signature", value+strings.Join(chunks, " "))
+	w.Flush()
+	return out.String(), nil
+}
+
+// Returns the signer to sign messages with, or nil if DKIM is disabled.
+func currentDKIMSigner() *DKIMSigner {
+	return dkimSigner.Load()
+}
+
+type headerField struct {
+	name  string
+	value string // Raw value, with its folding but without the final line ending
+}
+
+// Splits a header block into fields, keeping folded lines with their field.
+func splitHeaderFields(header string) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += line
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		fields = append(fields, headerField{name: name, value: value})
+	}
+	for i := range fields {
+		fields[i].value = strings.TrimSuffix(fields[i].value, "\r\n")
+	}
+	return fields
+}
+
+// Canonicalizes a header field with the relaxed algorithm: lowercase name, unfolded value
+// with whitespace runs reduced to one space and trimmed. Returns it without line ending.
+func canonicalHeaderRelaxed(name string, value string) string {
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// Canonicalizes a body with the relaxed algorithm: whitespace runs reduced to one space,
+// trailing whitespace and empty lines at the end removed.
+func canonicalBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	var out strings.Builder
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRight(wspRun.ReplaceAllString(line, " "), " ")
+		if line == "" {
+			blank++
+			continue
+		}
+		out.WriteString(strings.Repeat("\r\n", blank))
+		blank = 0
+		out.WriteString(line + "\r\n")
+	}
+	return []byte(out.String())
+}
+
+var wspRun = regexp.MustCompile(`[ \t]+`)
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
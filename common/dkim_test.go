@@ -0,0 +1,166 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalHeaderRelaxed(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string // Raw field, with its folding but without the final line ending
+		want  string
+	}{
+		// RFC 6376, section 3.4.5
+		{name: "RFC 6376 example A", field: "A: X", want: "a:X"},
+		{name: "RFC 6376 example B", field: "B : Y\t\r\n\tZ  ", want: "b:Y Z"},
+		{name: "name lowercased", field: "Message-ID: <123@example.com>", want: "message-id:<123@example.com>"},
+		{name: "whitespace runs reduced", field: "Subject:  Hello \t  world", want: "subject:Hello world"},
+		{name: "folding removed", field: "To: a@example.com,\r\n b@example.com", want: "to:a@example.com, b@example.com"},
+		{name: "empty value", field: "Cc:", want: "cc:"},
+		{name: "whitespace only value", field: "Cc: \t ", want: "cc:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := splitHeaderFields(tt.field + "\r\n")
+			if len(fields) != 1 {
+				t.Fatalf("got %d fields, want 1", len(fields))
+			}
+			got := canonicalHeaderRelaxed(fields[0].name, fields[0].value)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalBodyRelaxed(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		// RFC 6376, section 3.4.5
+		{name: "RFC 6376 example", body: " C \r\nD \t E\r\n\r\n\r\n", want: " C\r\nD E\r\n"},
+		{name: "empty body", body: "", want: ""},
+		{name: "only empty lines", body: "\r\n\r\n", want: ""},
+		{name: "missing final line ending", body: "Hello", want: "Hello\r\n"},
+		{name: "empty lines inside kept", body: "Hi.\r\n\r\nJoe.\r\n", want: "Hi.\r\n\r\nJoe.\r\n"},
+		{name: "trailing whitespace lines removed", body: "Hi.\r\n \t\r\n", want: "Hi.\r\n"},
+		{name: "leading whitespace reduced", body: "\t\tindented\r\n", want: " indented\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(canonicalBodyRelaxed([]byte(tt.body)))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The Ed25519 example of RFC 8463, appendix A.
+const (
+	rfc8463Seed      = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfc8463PublicKey = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	rfc8463Signature = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n"
+	rfc8463Message = "From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+)
+
+// Verifies a relaxed/relaxed Ed25519 signature of a message the way receivers do (RFC 6376, section 6.1.3).
+func verifyDKIMEd25519(t *testing.T, msg string, signatureField string, publicKey string) bool {
+	t.Helper()
+	header, _, _ := strings.Cut(msg, "\r\n\r\n")
+	fields := splitHeaderFields(header + "\r\n")
+	signature := splitHeaderFields(signatureField)[0]
+	tags, b, _ := strings.Cut(signature.value, " b=")
+
+	// the fields are signed in the order of h=, the same name is taken from the bottom up
+	var signed strings.Builder
+	used := map[int]bool{}
+	for _, tag := range strings.Split(strings.Join(strings.Fields(tags), ""), ";") {
+		names, ok := strings.CutPrefix(tag, "h=")
+		if !ok {
+			continue
+		}
+		for _, name := range strings.Split(names, ":") {
+			for i := len(fields) - 1; i >= 0; i-- {
+				if !used[i] && strings.EqualFold(fields[i].name, name) {
+					used[i] = true
+					signed.WriteString(canonicalHeaderRelaxed(fields[i].name, fields[i].value) + "\r\n")
+					break
+				}
+			}
+		}
+	}
+	signed.WriteString(canonicalHeaderRelaxed(signature.name, tags+" b="))
+
+	key, _ := base64.StdEncoding.DecodeString(publicKey)
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(b), ""))
+	if err != nil {
+		t.Fatalf("invalid b= tag: %v", err)
+	}
+	hash := sha256.Sum256([]byte(signed.String()))
+	return ed25519.Verify(key, hash[:], sig)
+}
+
+func TestDKIMRelaxedCanonicalizationRFC8463(t *testing.T) {
+	_, body, _ := strings.Cut(rfc8463Message, "\r\n\r\n")
+	bodyHash := sha256.Sum256(canonicalBodyRelaxed([]byte(body)))
+	if got := base64.StdEncoding.EncodeToString(bodyHash[:]); got != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" {
+		t.Errorf("got body hash %s", got)
+	}
+	if !verifyDKIMEd25519(t, rfc8463Message, rfc8463Signature, rfc8463PublicKey) {
+		t.Errorf("the signature of the RFC doesn't verify")
+	}
+}
+
+// Signs the message of the RFC and checks the signature with its public key.
+func TestDKIMSignerEd25519(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfc8463Seed)
+	signer := &DKIMSigner{Domain: "football.example.com", Selector: "brisbane", Key: ed25519.NewKeyFromSeed(seed)}
+
+	record, err := signer.DNSRecord()
+	if err != nil || record != "v=DKIM1; k=ed25519; p="+rfc8463PublicKey {
+		t.Errorf("got DNS record %q (error %v)", record, err)
+	}
+
+	header, err := signer.Sign([]byte(rfc8463Message))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	signature := splitHeaderFields(header)[0]
+	for _, tag := range []string{"a=ed25519-sha256;", "c=relaxed/relaxed;", "d=football.example.com;", "s=brisbane;",
+		"h=from:from:to:subject:date:message-id;", "bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;"} {
+		if !strings.Contains(canonicalHeaderRelaxed(signature.name, signature.value), tag) {
+			t.Errorf("the signature has no %s tag: %s", tag, header)
+		}
+	}
+	if !verifyDKIMEd25519(t, rfc8463Message, header, rfc8463PublicKey) {
+		t.Errorf("the signature doesn't verify: %s", header)
+	}
+
+	// a second From header added after signing breaks the signature
+	if verifyDKIMEd25519(t, "From: Mallory <mallory@example.org>\r\n"+rfc8463Message, header, rfc8463PublicKey) {
+		t.Errorf("the signature still verifies with a second From header")
+	}
+}
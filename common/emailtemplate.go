@@ -0,0 +1,254 @@
+package common
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// This file lets admins change the emails sent by the app (subject, HTML and text) without recompiling.
+//
+// Modules register their emails with RegisterEmailTemplate, with a default content usually rendered
+// from their templ components. Edits are saved in the email_templates table of the mail database:
+// every save is a new version, the latest one is used, and reverting saves an old version again,
+// so the history is never lost.
+//
+// The content uses the Go template syntax for variables, e.g. `{{.ResetURL}}` or `{{.AppName}}`.
+// Only the variables declared by the template (and the common ones, see commonEmailVariables) can be used,
+// and the values are escaped in the HTML, so an edit can't break the page or inject scripts.
+
+// A variable that can be used in an email template.
+type EmailTemplateVariable struct {
+	Name        string // Used as {{.Name}}
+	Description string // Shown in the editor
+	Sample      string // Value used in the preview
+}
+
+// An email sent by the app, with its default content.
+type EmailTemplate struct {
+	Name        string // Identifier, saved in Message.Template, e.g. "password_reset"
+	Title       string // Shown in the admin page, e.g. "Password Reset"
+	Description string // When the email is sent
+	Subject     string // Default subject
+	HTML        string // Default HTML body
+	Text        string // Default plain text body, generated from the HTML if empty
+	Variables   []EmailTemplateVariable
+}
+
+// A saved version of an email template. The default content has ID 0.
+type EmailTemplateVersion struct {
+	ID        int64     `db:"id"`
+	Name      string    `db:"name"`
+	Subject   string    `db:"subject"`
+	HTML      string    `db:"html"`
+	Text      string    `db:"text"`
+	EditedBy  string    `db:"edited_by"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+var (
+	emailTemplatesMu sync.Mutex
+	emailTemplates   = map[string]EmailTemplate{}
+)
+
+// Declares an email the admins can edit. Call it when the app starts, before sending the email.
+// Example:
+//
+//	RegisterEmailTemplate(EmailTemplate{
+//		Name:      "welcome",
+//		Title:     "Welcome",
+//		Subject:   "Welcome to {{.AppName}}",
+//		Text:      "Hi {{.Email}}, thanks for signing up.",
+//		Variables: []EmailTemplateVariable{{Name: "Email", Description: "Address of the new user", Sample: "jane@example.com"}},
+//	})
+func RegisterEmailTemplate(t EmailTemplate) {
+	emailTemplatesMu.Lock()
+	defer emailTemplatesMu.Unlock()
+	emailTemplates[t.Name] = t
+}
+
+// Returns the registered email templates, sorted by title.
+func EmailTemplates() []EmailTemplate {
+	emailTemplatesMu.Lock()
+	defer emailTemplatesMu.Unlock()
+	templates := make([]EmailTemplate, 0, len(emailTemplates))
+	for _, t := range emailTemplates {
+		templates = append(templates, t)
+	}
+	slices.SortFunc(templates, func(a, b EmailTemplate) int { return strings.Compare(a.Title, b.Title) })
+	return templates
+}
+
+// Returns a registered email template.
+func GetEmailTemplate(name string) (EmailTemplate, bool) {
+	emailTemplatesMu.Lock()
+	defer emailTemplatesMu.Unlock()
+	t, ok := emailTemplates[name]
+	return t, ok
+}
+
+// Returns the variables available in every email, with their values.
+func commonEmailVariables() []EmailTemplateVariable {
+	return []EmailTemplateVariable{
+		{Name: "AppName", Description: "Name of the app (APP_NAME)", Sample: Env.APP_NAME},
+		{Name: "BaseURL", Description: "Public URL of the app (BASE_URL)", Sample: Env.BASE_URL},
+	}
+}
+
+// Returns every variable that can be used in the template, the common ones first.
+func (t EmailTemplate) AllVariables() []EmailTemplateVariable {
+	return append(commonEmailVariables(), t.Variables...)
+}
+
+// Returns the values of the variables used in the preview.
+func (t EmailTemplate) SampleData() map[string]string {
+	data := map[string]string{}
+	for _, v := range t.Variables {
+		data[v.Name] = v.Sample
+	}
+	return data
+}
+
+// Returns the default content as a version.
+func (t EmailTemplate) DefaultVersion() EmailTemplateVersion {
+	return EmailTemplateVersion{Name: t.Name, Subject: t.Subject, HTML: t.HTML, Text: t.Text}
+}
+
+// Returns the content used to send the email: the latest saved version, or the default one.
+func CurrentEmailTemplate(name string) (EmailTemplateVersion, error) {
+	t, ok := GetEmailTemplate(name)
+	if !ok {
+		return EmailTemplateVersion{}, fmt.Errorf("unknown email template %q", name)
+	}
+	var version EmailTemplateVersion
+	err := MailDb.Get(&version, `SELECT * FROM email_templates WHERE name = ? ORDER BY id DESC LIMIT 1`, name)
+	if err == sql.ErrNoRows {
+		return t.DefaultVersion(), nil
+	}
+	return version, err
+}
+
+// Returns the saved versions of a template, newest first.
+func EmailTemplateHistory(name string) ([]EmailTemplateVersion, error) {
+	var versions []EmailTemplateVersion
+	err := MailDb.Select(&versions, `SELECT * FROM email_templates WHERE name = ? ORDER BY id DESC`, name)
+	return versions, err
+}
+
+// Checks that the content renders with the sample data and saves it as the new version of the template.
+// Returns the ID of the version.
+func SaveEmailTemplate(version EmailTemplateVersion, editedBy string) (int64, error) {
+	t, ok := GetEmailTemplate(version.Name)
+	if !ok {
+		return 0, fmt.Errorf("unknown email template %q", version.Name)
+	}
+	if strings.TrimSpace(version.Subject) == "" {
+		return 0, fmt.Errorf("the subject can't be empty")
+	}
+	if strings.TrimSpace(version.HTML) == "" && strings.TrimSpace(version.Text) == "" {
+		return 0, fmt.Errorf("the HTML and the text can't both be empty")
+	}
+	_, _, _, err := RenderEmailTemplate(version, t.SampleData())
+	if err != nil {
+		return 0, err
+	}
+	res, err := MailDb.Exec(`INSERT INTO email_templates (name, subject, html, text, edited_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		version.Name, version.Subject, version.HTML, version.Text, editedBy, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to save the email template: %v", err)
+	}
+	return res.LastInsertId()
+}
+
+// Saves an old version of the template (or the default content, with ID 0) as its new version.
+func RevertEmailTemplate(name string, id int64, editedBy string) (int64, error) {
+	t, ok := GetEmailTemplate(name)
+	if !ok {
+		return 0, fmt.Errorf("unknown email template %q", name)
+	}
+	version := t.DefaultVersion()
+	if id != 0 {
+		err := MailDb.Get(&version, `SELECT * FROM email_templates WHERE id = ? AND name = ?`, id, name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return SaveEmailTemplate(version, editedBy)
+}
+
+// Renders the subject, the HTML and the text of a version with the data, plus the common variables.
+// Using a variable that isn't in the data is an error.
+func RenderEmailTemplate(version EmailTemplateVersion, data map[string]string) (string, string, string, error) {
+	values := map[string]string{}
+	for _, v := range commonEmailVariables() {
+		values[v.Name] = v.Sample
+	}
+	for name, value := range data {
+		values[name] = value
+	}
+
+	var subject, text bytes.Buffer
+	tmpl, err := texttemplate.New("subject").Option("missingkey=error").Parse(version.Subject)
+	if err == nil {
+		err = tmpl.Execute(&subject, values)
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid subject: %v", err)
+	}
+	if strings.ContainsAny(subject.String(), "\r\n") {
+		return "", "", "", fmt.Errorf("invalid subject: it can't contain line breaks")
+	}
+
+	var html bytes.Buffer
+	htmlTmpl, err := htmltemplate.New("html").Option("missingkey=error").Parse(version.HTML)
+	if err == nil {
+		err = htmlTmpl.Execute(&html, values)
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid HTML: %v", err)
+	}
+
+	tmpl, err = texttemplate.New("text").Option("missingkey=error").Parse(version.Text)
+	if err == nil {
+		err = tmpl.Execute(&text, values)
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid text: %v", err)
+	}
+	return subject.String(), html.String(), text.String(), nil
+}
+
+// Fills the subject and the bodies of the message from an email template, and sets Message.Template.
+// If the edited template can't be rendered, the default content is used.
+// Example:
+//
+//	msg := &Message{To: []string{email}}
+//	err := msg.SetTemplate("password_reset", map[string]string{"ResetURL": resetURL})
+func (m *Message) SetTemplate(name string, data map[string]string) error {
+	t, ok := GetEmailTemplate(name)
+	if !ok {
+		return fmt.Errorf("unknown email template %q", name)
+	}
+	version, err := CurrentEmailTemplate(name)
+	if err != nil {
+		log.Printf("Error loading email template %s, using the default one: %v", name, err)
+		version = t.DefaultVersion()
+	}
+	subject, html, text, err := RenderEmailTemplate(version, data)
+	if err != nil && version.ID != 0 {
+		log.Printf("Error rendering email template %s version %d, using the default one: %v", name, version.ID, err)
+		subject, html, text, err = RenderEmailTemplate(t.DefaultVersion(), data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to render email template %s: %v", name, err)
+	}
+	m.Subject, m.HTML, m.Text, m.Template = subject, html, text, name
+	return nil
+}
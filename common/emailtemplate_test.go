@@ -0,0 +1,140 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderEmailTemplate(t *testing.T) {
+	previous := Env
+	Env.APP_NAME, Env.BASE_URL = "Test App", "https://app.example.com"
+	t.Cleanup(func() { Env = previous })
+
+	data := map[string]string{"Name": `<script>alert("hi")</script>`, "ResetURL": "https://app.example.com/reset?token=a&b"}
+	tests := []struct {
+		name        string
+		version     EmailTemplateVersion
+		wantSubject string
+		wantHTML    string
+		wantText    string
+		wantErr     string
+	}{
+		{
+			name:        "common variables",
+			version:     EmailTemplateVersion{Subject: "Welcome to {{.AppName}}", Text: "Visit {{.BaseURL}}"},
+			wantSubject: "Welcome to Test App",
+			wantText:    "Visit https://app.example.com",
+		},
+		{
+			name:        "values escaped in the HTML only",
+			version:     EmailTemplateVersion{Subject: "Hi {{.Name}}", HTML: "<p>Hi {{.Name}}</p>", Text: "Hi {{.Name}}"},
+			wantSubject: `Hi <script>alert("hi")</script>`,
+			wantHTML:    `<p>Hi &lt;script&gt;alert(&#34;hi&#34;)&lt;/script&gt;</p>`,
+			wantText:    `Hi <script>alert("hi")</script>`,
+		},
+		{
+			name:        "URL in an attribute",
+			version:     EmailTemplateVersion{Subject: "Reset", HTML: `<a href="{{.ResetURL}}">Reset</a>`},
+			wantSubject: "Reset",
+			wantHTML:    `<a href="https://app.example.com/reset?token=a&amp;b">Reset</a>`,
+		},
+		{
+			name:    "unknown variable",
+			version: EmailTemplateVersion{Subject: "Hi {{.Missing}}"},
+			wantErr: "invalid subject",
+		},
+		{
+			name:    "unknown variable in the HTML",
+			version: EmailTemplateVersion{Subject: "Hi", HTML: "<p>{{.Missing}}</p>"},
+			wantErr: "invalid HTML",
+		},
+		{
+			name:    "invalid syntax",
+			version: EmailTemplateVersion{Subject: "Hi", Text: "{{.Name"},
+			wantErr: "invalid text",
+		},
+		{
+			name:    "line break in the subject",
+			version: EmailTemplateVersion{Subject: "Hi\nBcc: victim@example.net"},
+			wantErr: "it can't contain line breaks",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, html, text, err := RenderEmailTemplate(tt.version, data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if subject != tt.wantSubject || html != tt.wantHTML || text != tt.wantText {
+				t.Errorf("got %q, %q and %q, want %q, %q and %q", subject, html, text, tt.wantSubject, tt.wantHTML, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestEmailTemplateVersions(t *testing.T) {
+	RegisterEmailTemplate(EmailTemplate{
+		Name:      "test_versions",
+		Title:     "Test",
+		Subject:   "Default for {{.Email}}",
+		Text:      "Default",
+		Variables: []EmailTemplateVariable{{Name: "Email", Sample: "jane@example.com"}},
+	})
+	subject := func() string {
+		t.Helper()
+		msg := &Message{}
+		err := msg.SetTemplate("test_versions", map[string]string{"Email": "john@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if msg.Template != "test_versions" {
+			t.Errorf("got template %q", msg.Template)
+		}
+		return msg.Subject
+	}
+
+	if got := subject(); got != "Default for john@example.com" {
+		t.Errorf("got subject %q before any edit", got)
+	}
+
+	_, err := SaveEmailTemplate(EmailTemplateVersion{Name: "test_versions", Subject: "Unknown {{.Token}}", Text: "Edited"}, "admin")
+	if err == nil {
+		t.Errorf("saved a version using an unknown variable")
+	}
+	id, err := SaveEmailTemplate(EmailTemplateVersion{Name: "test_versions", Subject: "Edited for {{.Email}}", Text: "Edited"}, "admin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := subject(); got != "Edited for john@example.com" {
+		t.Errorf("got subject %q after the edit", got)
+	}
+
+	// a saved version that can't be rendered anymore (e.g. a variable was removed) falls back to the default
+	_, err = MailDb.Exec(`INSERT INTO email_templates (name, subject, html, text, edited_by, created_at) VALUES (?, ?, '', 'Broken', 'admin', ?)`,
+		"test_versions", "Broken {{.Removed}}", time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := subject(); got != "Default for john@example.com" {
+		t.Errorf("got subject %q with a broken version", got)
+	}
+
+	_, err = RevertEmailTemplate("test_versions", id, "admin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := subject(); got != "Edited for john@example.com" {
+		t.Errorf("got subject %q after reverting", got)
+	}
+	history, err := EmailTemplateHistory("test_versions")
+	if err != nil || len(history) != 3 {
+		t.Errorf("got %d versions (error %v), want 3", len(history), err)
+	}
+}
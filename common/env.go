@@ -1,55 +1,547 @@
 package common
 
 import (
+	"encoding"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
+	"net/url"
 	"os"
 	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 // Env is a globally-accessible variable that holds the environment variables
-// for the application. It is initialized in the init function. Just import it in your
-// package and use it to access the environment variables.
+// for the application. It is loaded with the default options by LoadEnv, which main
+// calls first (see LoadEnvironment). Just import it in your package and use it to access
+// the environment variables.
 var Env = Environment{}
 
-func init() {
-	Env.init()
+// Describes every variable of Env: its effective value, where it came from and its problems, if any.
+// It's filled alongside Env and meant for the admin configuration page.
+var EnvInfo []EnvVarInfo
+
+// Loads the environment with the default options into Env and EnvInfo.
+// Returns an *EnvError listing every problem if a variable is missing or invalid.
+// Call it before anything reading Env, e.g. LoadMailSettings.
+func LoadEnv() error {
+	env, info, err := loadEnvironment(EnvOptions{})
+	Env, EnvInfo = env, info
+	return err
 }
 
 type Environment struct {
 	// Use the `env` tag to specify the name of the environment variable.
 	// Use the `default` tag to specify a default value. If a variable is not found
-	// and a default value is not specified, the application will panic.
+	// and a default value is not specified, loading the environment fails.
+	//
+	// Fields can be strings, ints, uints, floats, bools, time.Duration, url.URL,
+	// any type implementing encoding.TextUnmarshaler, or slices of those
+	// (comma-separated, e.g. `a,b,c`).
+	//
+	// Use the `validate` tag to add comma-separated validation rules:
+	//   - required: the value can't be empty
+	//   - oneof=a b c: the value must be one of the space-separated options
+	//   - min=N, max=N: bounds for numbers and durations, or for the length of strings and slices
+	//   - url: the value must be an absolute URL (e.g. https://example.com)
+	// Use the `pattern` tag to specify a regular expression the value must match.
+	// All problems are reported together when the application starts.
+	//
+	// Any variable can also be read from a file by setting `<NAME>_FILE` to its path
+	// (e.g. `SECRET_KEY_FILE=/run/secrets/secret_key` with Docker secrets). Trailing newlines are trimmed.
+	// Use the `secret:"true"` tag for sensitive values, they are never logged or printed.
+	//
+	// Describe each field with a trailing comment and group fields under a comment header,
+	// `make env-docs` uses both to generate .env.example and CONFIGURATION.md.
 
 	// Application settings
-	ENVIRONMENT string `env:"ENVIRONMENT" default:"production"` // development, production, test
-	BASE_URL    string `env:"BASE_URL" default:"http://localhost:3000"`
+	ENVIRONMENT string `env:"ENVIRONMENT" default:"production" validate:"required,oneof=development production test"` // The environment the app runs in
+	BASE_URL    string `env:"BASE_URL" default:"http://localhost:3000" validate:"required,url"`                       // The public URL of the app, used in links (e.g. in emails)
+	APP_NAME    string `env:"APP_NAME" default:"Go on Rails"`                                                         // The name of the app shown to users (e.g. in emails)
+	PORT        int    `env:"PORT" default:"3000" validate:"min=1,max=65535"`                                         // The port the HTTP server listens on
+
+	// Mail settings
+	MAIL_TRANSPORT     string        `env:"MAIL_TRANSPORT" default:"" validate:"oneof=smtp sendmail file memory mailbox"` // How emails are delivered. Overrides the admin setting if set. Default: mailbox in development
+	MAIL_FROM          string        `env:"MAIL_FROM" default:""`                                                         // Sender used when the SMTP settings don't set one. Default: noreply@ the BASE_URL host
+	MAIL_DIR           string        `env:"MAIL_DIR" default:"./db/mail"`                                                 // Where the file transport saves .eml files
+	SENDMAIL_PATH      string        `env:"SENDMAIL_PATH" default:"/usr/sbin/sendmail"`                                   // Path of the sendmail binary used by the sendmail transport
+	MAIL_LOG_RETENTION time.Duration `env:"MAIL_LOG_RETENTION" default:"720h" validate:"min=0s"`                          // How long sent, failed, dropped and suppressed emails stay in the delivery log, e.g. 720h for 30 days. 0 keeps them forever
+
+	// Bounce settings
+	BOUNCE_WEBHOOK_TOKEN string `env:"BOUNCE_WEBHOOK_TOKEN" default:"" secret:"true"` // Token required to post bounces and complaints to /bounces (as a Bearer token or ?token=). The endpoint is disabled when empty
+	BOUNCE_MAILDIR       string `env:"BOUNCE_MAILDIR" default:""`                     // Maildir read every minute for bounces and complaints, e.g. the mailbox of the Return-Path address. Disabled when empty
+
+	// Secrets settings
+	SECRETS_KEY      []string `env:"SECRETS_KEY" default:"" secret:"true"`        // Comma-separated base64 AES-256 keys encrypting the secrets saved in the databases. The first one encrypts, the others only decrypt (for rotation). Default: a key generated in SECRETS_KEY_PATH
+	SECRETS_KEY_PATH string   `env:"SECRETS_KEY_PATH" default:"./db/secrets.key"` // Where the secrets key is generated when SECRETS_KEY isn't set
 
 	// * Add more environment variables here
 }
 
-func (e *Environment) init() {
-	err := godotenv.Load()
+type EnvOptions struct {
+	EnvFile   string                                   // Path of the base env file. Default: .env
+	SkipFiles bool                                     // Only use Lookup, don't read any env file. Default: false
+	Lookup    func(key string) (value string, ok bool) // Looks up a variable in the process environment. Default: os.LookupEnv
+	ReadFile  func(path string) ([]byte, error)        // Reads the files given by `<NAME>_FILE` variables. Default: os.ReadFile
+}
+
+// Loads the environment variables into a new Environment, without modifying the process environment.
+//
+// Variables are looked up in the process environment first, then in the env files,
+// from the most specific to the least specific:
+//   - .env.local (machine-specific overrides, shouldn't be committed)
+//   - .env.<ENVIRONMENT> (e.g. .env.development)
+//   - .env
+//
+// Files that don't exist are skipped. The `.local` and `.<ENVIRONMENT>` suffixes are added to EnvFile
+// when a custom path is given. Every problem (missing variable, invalid value, failed validation)
+// is returned at once in an *EnvError.
+// Example (in a test):
+//
+//	env, err := LoadEnvironment(EnvOptions{
+//		SkipFiles: true,
+//		Lookup: func(key string) (string, bool) {
+//			value, ok := map[string]string{"ENVIRONMENT": "test"}[key]
+//			return value, ok
+//		},
+//	})
+func LoadEnvironment(opts EnvOptions) (Environment, error) {
+	env, _, err := loadEnvironment(opts)
+	return env, err
+}
+
+// Describes an environment variable once loaded.
+type EnvVarInfo struct {
+	Name     string   // The name of the environment variable.
+	Type     string   // The Go type of the field.
+	Value    string   // The effective value, redacted if the field is a secret.
+	Source   string   // Where the value came from: "env", the env file path, "<NAME>_FILE" or "default".
+	Secret   bool     // Whether the field is tagged as secret.
+	Problems []string // Why the value is invalid, empty if it's valid.
+}
+
+// Same as LoadEnvironment, but also describes every variable, see EnvVarInfo.
+func loadEnvironment(opts EnvOptions) (Environment, []EnvVarInfo, error) {
+	if opts.EnvFile == "" {
+		opts.EnvFile = ".env"
+	}
+	if opts.Lookup == nil {
+		opts.Lookup = os.LookupEnv
+	}
+	if opts.ReadFile == nil {
+		opts.ReadFile = os.ReadFile
+	}
+
+	env := Environment{}
+	envErr := &EnvError{}
+	layers := envLayers(opts, envErr)
+	var infos []EnvVarInfo
+
+	// collect every problem so they can all be fixed at once
+	val := reflect.ValueOf(&env).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		envVar, ok := field.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		info := EnvVarInfo{
+			Name:   envVar,
+			Type:   field.Type.String(),
+			Secret: field.Tag.Get("secret") == "true",
+		}
+		addProblem := func(problem string) {
+			problem = redactEnvProblem(problem, info.Value, info.Secret)
+			info.Problems = append(info.Problems, problem)
+			envErr.Add(envVar, problem)
+		}
+		info.Value, info.Source = loadEnvValue(field, layers, opts, addProblem)
+
+		if len(info.Problems) == 0 {
+			err := setEnvField(val.Field(i), info.Value)
+			if err != nil {
+				addProblem(err.Error())
+			} else {
+				for _, problem := range validateEnvField(field, val.Field(i), info.Value) {
+					addProblem(problem)
+				}
+			}
+		}
+
+		// only show the parsed value once we're done reporting problems
+		if len(info.Problems) == 0 {
+			info.Value = envFieldString(field, val.Field(i))
+		} else if info.Secret && info.Value != "" {
+			info.Value = "[redacted]"
+		}
+		infos = append(infos, info)
+	}
+	if len(envErr.Problems) > 0 {
+		return env, infos, envErr
+	}
+	return env, infos, nil
+}
+
+// Finds the raw value of a field and where it came from: one of the layers, a `<NAME>_FILE` file or the default.
+func loadEnvValue(field reflect.StructField, layers envLayerList, opts EnvOptions, addProblem func(string)) (string, string) {
+	envVar := field.Tag.Get("env")
+	envValue, source, _ := layers.lookup(envVar)
+
+	filePath, _, _ := layers.lookup(envVar + "_FILE")
+	fileValue, err := readEnvFile(envVar, filePath, opts.ReadFile)
+	if err != nil {
+		addProblem(err.Error())
+		return "", envVar + "_FILE"
+	}
+	if fileValue != "" {
+		if envValue != "" {
+			addProblem(fmt.Sprintf("both %s and %s_FILE are set, use only one of them", envVar, envVar))
+			return "", source
+		}
+		return fileValue, envVar + "_FILE"
+	}
+
+	if envValue != "" {
+		return envValue, source
+	}
+	defaultValue, ok := field.Tag.Lookup("default")
+	if !ok {
+		addProblem("not found and has no default value")
+		return "", ""
+	}
+	if field.Tag.Get("secret") == "true" {
+		log.Printf("Using default value for %s", envVar)
+	} else {
+		log.Printf("Using default value for %s: %s", envVar, defaultValue)
+	}
+	return defaultValue, "default"
+}
+
+// A source of environment variables, either the process environment or an env file.
+type envLayer struct {
+	name   string
+	lookup func(key string) (string, bool)
+}
+
+// Sources of environment variables, from the highest to the lowest priority.
+type envLayerList []envLayer
+
+// Returns the first non-empty value of a variable and the name of the layer it was found in.
+func (l envLayerList) lookup(key string) (string, string, bool) {
+	for _, layer := range l {
+		value, ok := layer.lookup(key)
+		if ok && value != "" {
+			return value, layer.name, true
+		}
+	}
+	return "", "", false
+}
+
+// Builds the list of sources to look variables up in, see LoadEnvironment.
+func envLayers(opts EnvOptions, envErr *EnvError) envLayerList {
+	layers := envLayerList{{name: "env", lookup: opts.Lookup}}
+	if opts.SkipFiles {
+		return layers
+	}
+
+	fileLayer := func(path string) envLayer {
+		values, err := godotenv.Read(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			envErr.Add(path, fmt.Sprintf("can't read env file: %v", err))
+		}
+		return envLayer{name: path, lookup: func(key string) (string, bool) {
+			value, ok := values[key]
+			return value, ok
+		}}
+	}
+	local := fileLayer(opts.EnvFile + ".local")
+	base := fileLayer(opts.EnvFile)
+
+	// the ENVIRONMENT-specific file depends on the value found in the other sources
+	environment, _, ok := envLayerList{layers[0], local, base}.lookup("ENVIRONMENT")
+	if !ok {
+		field, _ := reflect.TypeOf(Environment{}).FieldByName("ENVIRONMENT")
+		environment = field.Tag.Get("default")
+	}
+	if environment == "" {
+		return append(layers, local, base)
+	}
+	return append(layers, local, fileLayer(opts.EnvFile+"."+environment), base)
+}
+
+// Reads the value of an environment variable from the file at path (i.e. `<NAME>_FILE`).
+// Returns an empty string if path is empty.
+func readEnvFile(envVar string, path string, readFile func(path string) ([]byte, error)) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	content, err := readFile(path)
 	if err != nil {
-		log.Printf("Error loading .env file: %v", err)
+		return "", fmt.Errorf("can't read %s_FILE: %v", envVar, err)
 	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Removes the value of a secret variable from a problem description, since problems get logged.
+func redactEnvProblem(problem string, value string, secret bool) string {
+	if !secret || value == "" {
+		return problem
+	}
+	problem = strings.ReplaceAll(problem, strconv.Quote(value), "[redacted]")
+	return strings.ReplaceAll(problem, value, "[redacted]")
+}
 
-	val := reflect.ValueOf(e).Elem()
+// Prints the environment as NAME=value lines, with the values of secret fields redacted.
+// This makes it safe to log the environment with fmt and log verbs (%v, %+v, %s).
+func (e Environment) String() string {
+	var lines []string
+	val := reflect.ValueOf(e)
 	for i := 0; i < val.NumField(); i++ {
 		field := val.Type().Field(i)
 		envVar, ok := field.Tag.Lookup("env")
 		if !ok {
 			continue
 		}
-		envValue := os.Getenv(envVar)
-		if envValue == "" {
-			envValue, ok = field.Tag.Lookup("default")
-			if !ok {
-				log.Panicf("Environment variable %s not found", envVar)
+		lines = append(lines, fmt.Sprintf("%s=%s", envVar, envFieldString(field, val.Field(i))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Same as String, so %#v doesn't print secrets either.
+func (e Environment) GoString() string {
+	return e.String()
+}
+
+// Formats the value of a field for display, redacting it if the field is a secret.
+func envFieldString(field reflect.StructField, value reflect.Value) string {
+	if field.Tag.Get("secret") == "true" {
+		if value.IsZero() {
+			return ""
+		}
+		return "[redacted]"
+	}
+	switch v := value.Interface().(type) {
+	case url.URL:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	if value.Kind() == reflect.Slice {
+		items := make([]string, value.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(value.Index(i).Interface())
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// Describes a problem with an environment variable.
+type EnvProblem struct {
+	Var     string // The name of the environment variable.
+	Problem string // What's wrong with it.
+}
+
+// Holds every problem found while loading the environment variables.
+type EnvError struct {
+	Problems []EnvProblem
+}
+
+func (e *EnvError) Add(envVar string, problem string) {
+	e.Problems = append(e.Problems, EnvProblem{Var: envVar, Problem: problem})
+}
+
+func (e *EnvError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = fmt.Sprintf("  - %s: %s", p.Var, p.Problem)
+	}
+	return "invalid environment:\n" + strings.Join(lines, "\n")
+}
+
+// Checks the parsed value of a field against its `validate` and `pattern` tags.
+// Returns a description of every rule that isn't satisfied.
+func validateEnvField(field reflect.StructField, value reflect.Value, raw string) []string {
+	var problems []string
+
+	rules := field.Tag.Get("validate")
+	if rules != "" {
+		for _, rule := range strings.Split(rules, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+			problem := checkEnvRule(name, arg, value, raw)
+			if problem != "" {
+				problems = append(problems, problem)
 			}
-			log.Printf("Using default value for %s: %s", envVar, envValue)
 		}
-		val.Field(i).SetString(envValue)
 	}
+
+	pattern, ok := field.Tag.Lookup("pattern")
+	if ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid pattern %q: %v", pattern, err))
+		} else if !re.MatchString(raw) {
+			problems = append(problems, fmt.Sprintf("must match the pattern %s", pattern))
+		}
+	}
+
+	return problems
+}
+
+// Checks a single validation rule. Returns an empty string if the rule is satisfied.
+func checkEnvRule(name string, arg string, value reflect.Value, raw string) string {
+	switch name {
+	case "required":
+		if strings.TrimSpace(raw) == "" {
+			return "is required"
+		}
+	case "oneof":
+		options := strings.Fields(arg)
+		values := []string{raw}
+		if value.Kind() == reflect.Slice {
+			values = strings.Split(raw, ",")
+		}
+		for _, v := range values {
+			v = strings.TrimSpace(v)
+			if v != "" && !slices.Contains(options, v) {
+				return fmt.Sprintf("must be one of %s (got %q)", strings.Join(options, ", "), v)
+			}
+		}
+	case "min", "max":
+		n, bound, err := envBound(value, arg)
+		if err != nil {
+			return fmt.Sprintf("invalid %s rule: %v", name, err)
+		}
+		if name == "min" && n < bound {
+			return fmt.Sprintf("must be at least %s", arg)
+		}
+		if name == "max" && n > bound {
+			return fmt.Sprintf("must be at most %s", arg)
+		}
+	case "url":
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Sprintf("must be an absolute URL like https://example.com (got %q)", raw)
+		}
+	default:
+		return fmt.Sprintf("unknown validation rule %q", name)
+	}
+	return ""
+}
+
+// Returns the value to compare against min/max rules and the parsed bound.
+// Numbers and durations are compared by value, strings and slices by length.
+func envBound(value reflect.Value, arg string) (float64, float64, error) {
+	if value.Type() == durationType {
+		bound, err := time.ParseDuration(arg)
+		return float64(value.Int()), float64(bound), err
+	}
+
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), bound, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), bound, nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), bound, nil
+	case reflect.String, reflect.Slice:
+		return float64(value.Len()), bound, nil
+	}
+	return 0, 0, fmt.Errorf("not supported for %s", value.Type())
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var urlType = reflect.TypeOf(url.URL{})
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Parses the raw value of an environment variable into the given field based on its type.
+func setEnvField(field reflect.Value, raw string) error {
+	// types with custom parsing come first, since they share a kind with the basic types
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("can't parse %q as a duration (e.g. 30s, 5m, 1h): %v", raw, err)
+		}
+		field.SetInt(int64(d))
+		return nil
+	case field.Type() == urlType:
+		u, err := url.Parse(raw)
+		if err != nil {
+			return fmt.Errorf("can't parse %q as a URL: %v", raw, err)
+		}
+		field.Set(reflect.ValueOf(*u))
+		return nil
+	case reflect.PointerTo(field.Type()).Implements(textUnmarshalerType):
+		err := field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(raw))
+		if err != nil {
+			return fmt.Errorf("can't parse %q as %s: %v", raw, field.Type(), err)
+		}
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("can't parse %q as a bool (use true or false)", raw)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("can't parse %q as an integer: %v", raw, numErr(err))
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("can't parse %q as a positive integer: %v", raw, numErr(err))
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("can't parse %q as a number: %v", raw, numErr(err))
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		// comma-separated values, each one parsed according to the element type
+		parts := []string{}
+		if strings.TrimSpace(raw) != "" {
+			parts = strings.Split(raw, ",")
+		}
+		slice := reflect.MakeSlice(field.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			err := setEnvField(slice.Index(i), strings.TrimSpace(part))
+			if err != nil {
+				return fmt.Errorf("item %d: %v", i, err)
+			}
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// Returns the reason of a strconv error without the function name (e.g. "value out of range").
+func numErr(err error) error {
+	if numError, ok := err.(*strconv.NumError); ok {
+		return numError.Err
+	}
+	return err
 }
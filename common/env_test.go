@@ -0,0 +1,224 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadEnvironmentLayers(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      map[string]string // Env files by suffix of EnvFile
+		vars       map[string]string // Process environment
+		wantValue  string
+		wantSource string // Suffix of EnvFile, or "env" or "default"
+	}{
+		{
+			name:       "base file",
+			files:      map[string]string{"": "APP_NAME=Base"},
+			wantValue:  "Base",
+			wantSource: "",
+		},
+		{
+			name:       "environment file over the base file",
+			files:      map[string]string{"": "APP_NAME=Base", ".production": "APP_NAME=Production"},
+			wantValue:  "Production",
+			wantSource: ".production",
+		},
+		{
+			name:       "local file over the environment file",
+			files:      map[string]string{"": "APP_NAME=Base", ".production": "APP_NAME=Production", ".local": "APP_NAME=Local"},
+			wantValue:  "Local",
+			wantSource: ".local",
+		},
+		{
+			name:       "process environment over every file",
+			files:      map[string]string{"": "APP_NAME=Base", ".production": "APP_NAME=Production", ".local": "APP_NAME=Local"},
+			vars:       map[string]string{"APP_NAME": "Env"},
+			wantValue:  "Env",
+			wantSource: "env",
+		},
+		{
+			name:       "empty value falls through",
+			files:      map[string]string{"": "APP_NAME=Base", ".local": "APP_NAME="},
+			vars:       map[string]string{"APP_NAME": ""},
+			wantValue:  "Base",
+			wantSource: "",
+		},
+		{
+			name:       "ENVIRONMENT from the base file picks the environment file",
+			files:      map[string]string{"": "ENVIRONMENT=development\nAPP_NAME=Base", ".development": "APP_NAME=Development", ".production": "APP_NAME=Production"},
+			wantValue:  "Development",
+			wantSource: ".development",
+		},
+		{
+			name:       "ENVIRONMENT from the process environment picks the environment file",
+			files:      map[string]string{"": "ENVIRONMENT=development", ".test": "APP_NAME=Test", ".development": "APP_NAME=Development"},
+			vars:       map[string]string{"ENVIRONMENT": "test"},
+			wantValue:  "Test",
+			wantSource: ".test",
+		},
+		{
+			name:       "ENVIRONMENT can't come from the environment file",
+			files:      map[string]string{".production": "ENVIRONMENT=development\nAPP_NAME=Production", ".development": "APP_NAME=Development"},
+			wantValue:  "Production",
+			wantSource: ".production",
+		},
+		{
+			name:       "default without files",
+			wantValue:  "Go on Rails",
+			wantSource: "default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envFile := filepath.Join(t.TempDir(), ".env")
+			for suffix, content := range tt.files {
+				err := os.WriteFile(envFile+suffix, []byte(content+"\n"), 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			env, infos, err := loadEnvironment(EnvOptions{EnvFile: envFile, Lookup: lookupMap(tt.vars)})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if env.APP_NAME != tt.wantValue {
+				t.Errorf("got APP_NAME %q, want %q", env.APP_NAME, tt.wantValue)
+			}
+			wantSource := tt.wantSource
+			if wantSource != "env" && wantSource != "default" {
+				wantSource = envFile + wantSource
+			}
+			if source := findEnvVarInfo(t, infos, "APP_NAME").Source; source != wantSource {
+				t.Errorf("got source %q, want %q", source, wantSource)
+			}
+		})
+	}
+}
+
+func TestLoadEnvironmentUnreadableFile(t *testing.T) {
+	// a directory can't be read as an env file, unlike a missing file which is skipped
+	envFile := filepath.Join(t.TempDir(), ".env")
+	err := os.Mkdir(envFile+".local", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = loadEnvironment(EnvOptions{EnvFile: envFile, Lookup: lookupMap(nil)})
+	if err == nil || !strings.Contains(err.Error(), "can't read env file") {
+		t.Fatalf("got error %v, want the env file to be unreadable", err)
+	}
+}
+
+func TestLoadEnvironmentFile(t *testing.T) {
+	files := map[string]string{
+		"/run/secrets/app_name":   "My App\n",
+		"/run/secrets/crlf":       "My App\r\n",
+		"/run/secrets/multi_line": "first\nsecond\n\n",
+		"/run/secrets/empty":      "",
+	}
+	readFile := func(path string) ([]byte, error) {
+		content, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("open %s: no such file or directory", path)
+		}
+		return []byte(content), nil
+	}
+
+	tests := []struct {
+		name       string
+		vars       map[string]string
+		wantValue  string
+		wantSource string
+		wantErr    string
+	}{
+		{
+			name:       "value from the file",
+			vars:       map[string]string{"APP_NAME_FILE": "/run/secrets/app_name"},
+			wantValue:  "My App",
+			wantSource: "APP_NAME_FILE",
+		},
+		{
+			name:       "trailing CRLF trimmed",
+			vars:       map[string]string{"APP_NAME_FILE": "/run/secrets/crlf"},
+			wantValue:  "My App",
+			wantSource: "APP_NAME_FILE",
+		},
+		{
+			name:       "only trailing newlines trimmed",
+			vars:       map[string]string{"APP_NAME_FILE": "/run/secrets/multi_line"},
+			wantValue:  "first\nsecond",
+			wantSource: "APP_NAME_FILE",
+		},
+		{
+			name:       "empty file falls back to the variable",
+			vars:       map[string]string{"APP_NAME_FILE": "/run/secrets/empty", "APP_NAME": "From Env"},
+			wantValue:  "From Env",
+			wantSource: "env",
+		},
+		{
+			name:       "empty path ignored",
+			vars:       map[string]string{"APP_NAME_FILE": ""},
+			wantValue:  "Go on Rails",
+			wantSource: "default",
+		},
+		{
+			name:    "both the variable and the file",
+			vars:    map[string]string{"APP_NAME_FILE": "/run/secrets/app_name", "APP_NAME": "From Env"},
+			wantErr: "both APP_NAME and APP_NAME_FILE are set",
+		},
+		{
+			name:    "missing file",
+			vars:    map[string]string{"APP_NAME_FILE": "/run/secrets/missing"},
+			wantErr: "can't read APP_NAME_FILE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, infos, err := loadEnvironment(EnvOptions{SkipFiles: true, Lookup: lookupMap(tt.vars), ReadFile: readFile})
+			info := findEnvVarInfo(t, infos, "APP_NAME")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				if len(info.Problems) == 0 {
+					t.Errorf("APP_NAME has no problems, want %q", tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if env.APP_NAME != tt.wantValue {
+				t.Errorf("got APP_NAME %q, want %q", env.APP_NAME, tt.wantValue)
+			}
+			if info.Source != tt.wantSource {
+				t.Errorf("got source %q, want %q", info.Source, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestLoadEnvironmentSecretFileRedacted(t *testing.T) {
+	readFile := func(path string) ([]byte, error) {
+		return []byte("s3cret-token\n"), nil
+	}
+	vars := map[string]string{"BOUNCE_WEBHOOK_TOKEN_FILE": "/run/secrets/token"}
+	env, infos, err := loadEnvironment(EnvOptions{SkipFiles: true, Lookup: lookupMap(vars), ReadFile: readFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if env.BOUNCE_WEBHOOK_TOKEN != "s3cret-token" {
+		t.Errorf("got token %q", env.BOUNCE_WEBHOOK_TOKEN)
+	}
+	info := findEnvVarInfo(t, infos, "BOUNCE_WEBHOOK_TOKEN")
+	if info.Value != "[redacted]" || !info.Secret {
+		t.Errorf("got value %q and secret %v, want it redacted", info.Value, info.Secret)
+	}
+	if strings.Contains(env.String(), "s3cret-token") {
+		t.Errorf("the secret is printed: %s", env.String())
+	}
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// This file converts the HTML of an email into the plain text alternative that is sent with it,
+// for clients that don't render HTML and for spam filters that penalise HTML-only emails.
+// It's not a full HTML parser, it only has to handle the markup of our email templates.
+
+var (
+	htmlCommentRegex   = regexp.MustCompile(`(?s)<!--.*?-->|<![^>]*>`)
+	htmlInvisibleRegex = []*regexp.Regexp{
+		regexp.MustCompile(`(?is)<head\b.*?</head\s*>`),
+		regexp.MustCompile(`(?is)<style\b.*?</style\s*>`),
+		regexp.MustCompile(`(?is)<script\b.*?</script\s*>`),
+	}
+	htmlTagRegex    = regexp.MustCompile(`(?s)<(/?)([a-zA-Z0-9]+)([^>]*)>`)
+	htmlHrefRegex   = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	whitespaceRegex = regexp.MustCompile(`[ \t\r\n\f]+`)
+	blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+)
+
+// Tags that start a new line (or a new paragraph for the ones set to true).
+var htmlBlockTags = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"table": true, "ul": true, "ol": true, "blockquote": true, "pre": true, "hr": true,
+	"div": false, "section": false, "article": false, "header": false, "footer": false,
+	"tr": false, "li": false, "br": false, "body": false,
+}
+
+// Converts HTML to readable plain text: block elements become line breaks, list items
+// become dashes and links are written as `text (url)`.
+// Example:
+//
+//	HTMLToText(`<p>Hello <a href="https://example.com">there</a></p>`) // "Hello there (https://example.com)"
+func HTMLToText(s string) string {
+	s = htmlCommentRegex.ReplaceAllString(s, "")
+	for _, re := range htmlInvisibleRegex {
+		s = re.ReplaceAllString(s, "")
+	}
+
+	var b strings.Builder
+	var href, linkText string
+	inLink := false
+	writeText := func(text string) {
+		text = whitespaceRegex.ReplaceAllString(html.UnescapeString(text), " ")
+		if inLink {
+			linkText += text
+			return
+		}
+		// don't start a line with a space
+		if strings.HasSuffix(b.String(), "\n") || b.Len() == 0 {
+			text = strings.TrimLeft(text, " ")
+		}
+		b.WriteString(text)
+	}
+
+	last := 0
+	for _, match := range htmlTagRegex.FindAllStringSubmatchIndex(s, -1) {
+		writeText(s[last:match[0]])
+		last = match[1]
+
+		closing := s[match[2]:match[3]] == "/"
+		tag := strings.ToLower(s[match[4]:match[5]])
+		attrs := s[match[6]:match[7]]
+
+		switch {
+		case tag == "a" && !closing:
+			inLink, linkText, href = true, "", ""
+			if m := htmlHrefRegex.FindStringSubmatch(attrs); m != nil {
+				href = html.UnescapeString(m[1] + m[2] + m[3])
+			}
+		case tag == "a" && closing && inLink:
+			inLink = false
+			text := strings.TrimSpace(linkText)
+			switch {
+			case href == "" || strings.HasPrefix(href, "#") || href == text:
+				writeText(text)
+			case text == "":
+				writeText(href)
+			default:
+				writeText(text + " (" + strings.TrimPrefix(href, "mailto:") + ")")
+			}
+		case tag == "li" && !closing:
+			b.WriteString("\n- ")
+		default:
+			paragraph, ok := htmlBlockTags[tag]
+			if !ok || (tag == "li" && closing) {
+				continue
+			}
+			b.WriteString(TernaryIf(paragraph, "\n\n", "\n"))
+		}
+	}
+	writeText(s[last:])
+
+	// trim every line and collapse the blank lines left by nested blocks
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text := blankLinesRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
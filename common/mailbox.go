@@ -0,0 +1,56 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// This file captures outgoing emails in the mail database instead of sending them.
+// It's the transport used when ENVIRONMENT=development, so flows like "forgot password"
+// can be tested locally without an SMTP server. The captured emails are shown at /dev/mailbox.
+
+// How many emails the mailbox keeps, older ones are deleted.
+const MailboxSize = 500
+
+// An email captured by MailboxTransport.
+type MailboxMessage struct {
+	ID         int       `db:"id"`
+	Sender     string    `db:"sender"`     // Envelope sender
+	Recipients string    `db:"recipients"` // Envelope recipients, comma-separated
+	Subject    string    `db:"subject"`
+	Raw        []byte    `db:"raw"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// Saves messages in the mailbox table of the mail database instead of sending them.
+type MailboxTransport struct{}
+
+func (t MailboxTransport) Send(msg *Message) error {
+	_, err := t.SendWithResponse(msg)
+	return err
+}
+
+// Returns the mailbox URL of the message as the response.
+func (MailboxTransport) SendWithResponse(msg *Message) (string, error) {
+	from, to, err := msg.envelope()
+	if err != nil {
+		return "", err
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := MailDb.Exec(`INSERT INTO mailbox (sender, recipients, subject, raw) VALUES (?, ?, ?, ?)`,
+		from, strings.Join(to, ", "), msg.Subject, raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to save message in the mailbox: %v", err)
+	}
+	_, err = MailDb.Exec(`DELETE FROM mailbox WHERE id <= (SELECT MAX(id) FROM mailbox) - ?`, MailboxSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to clean up the mailbox: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	return fmt.Sprintf("saved as /dev/mailbox/%d", id), nil
+}
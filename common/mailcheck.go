@@ -0,0 +1,209 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file checks SMTP settings step by step, so the admin page can tell exactly
+// what's wrong (a typo in the host, a blocked port, a bad certificate, a wrong password...)
+// instead of a single error when the first email fails.
+
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// The outcome of a step of MailerT.Check.
+type MailerCheckStep struct {
+	Name     string
+	Status   string // One of CheckOK, CheckFailed or CheckSkipped
+	Detail   string // What was found, or the error
+	Duration time.Duration
+}
+
+// Checks the settings by validating them, resolving the host, connecting, encrypting the connection, authenticating
+// and sending a test email to the given address, in the order a real delivery does them.
+// Returns the steps that were run: the last one is the one that failed, if any.
+func (m *MailerT) Check(to string) []MailerCheckStep {
+	var steps []MailerCheckStep
+	run := func(name string, step func() (string, error)) bool {
+		start := time.Now()
+		detail, err := step()
+		result := MailerCheckStep{Name: name, Status: CheckOK, Detail: detail, Duration: time.Since(start)}
+		if err != nil {
+			result.Status, result.Detail = CheckFailed, err.Error()
+		}
+		steps = append(steps, result)
+		return err == nil
+	}
+	skip := func(name, detail string) {
+		steps = append(steps, MailerCheckStep{Name: name, Status: CheckSkipped, Detail: detail})
+	}
+
+	ok := run("Settings", func() (string, error) {
+		err := m.validate()
+		if err != nil {
+			return "", err
+		}
+		return "the settings are complete and well formed", nil
+	})
+	if !ok {
+		return steps
+	}
+	tlsConfig, err := m.tlsConfig()
+	if err != nil {
+		run("TLS handshake", func() (string, error) { return "", err })
+		return steps
+	}
+
+	ok = run("DNS resolution", func() (string, error) {
+		if net.ParseIP(m.Host) != nil {
+			return m.Host + " is an IP address", nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupHost(ctx, m.Host)
+		if err != nil {
+			return "", fmt.Errorf("can't resolve %s: %v", m.Host, err)
+		}
+		return m.Host + " resolves to " + strings.Join(ips, ", "), nil
+	})
+	if !ok {
+		return steps
+	}
+
+	var conn net.Conn
+	ok = run("TCP connection", func() (string, error) {
+		addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+		var err error
+		conn, err = net.DialTimeout("tcp", addr, 10*time.Second)
+		if err != nil {
+			return "", fmt.Errorf("can't connect to %s: %v", addr, err)
+		}
+		return "connected to " + conn.RemoteAddr().String(), nil
+	})
+	if !ok {
+		return steps
+	}
+	defer conn.Close()
+	// don't let a server that stops answering hang the admin page
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	if m.TLSMode == TLSModeTLS {
+		ok = run("TLS handshake", func() (string, error) {
+			tlsConn := tls.Client(conn, tlsConfig)
+			err := tlsConn.Handshake()
+			if err != nil {
+				return "", fmt.Errorf("implicit TLS handshake failed: %v", err)
+			}
+			conn = tlsConn
+			return describeTLS(tlsConn.ConnectionState()), nil
+		})
+		if !ok {
+			return steps
+		}
+	}
+
+	var client *smtp.Client
+	ok = run("SMTP greeting", func() (string, error) {
+		var err error
+		client, err = smtp.NewClient(conn, m.Host)
+		if err != nil {
+			return "", fmt.Errorf("the server didn't greet us as an SMTP server: %v", err)
+		}
+		if err = client.Hello("localhost"); err != nil {
+			return "", fmt.Errorf("EHLO failed: %v", err)
+		}
+		var extensions []string
+		for _, name := range []string{"STARTTLS", "AUTH", "SIZE", "8BITMIME", "SMTPUTF8"} {
+			if ok, params := client.Extension(name); ok {
+				extensions = append(extensions, strings.TrimSpace(name+" "+params))
+			}
+		}
+		if len(extensions) == 0 {
+			return "the server is ready and supports no extensions", nil
+		}
+		return "the server is ready and supports " + strings.Join(extensions, ", "), nil
+	})
+	if !ok {
+		return steps
+	}
+	defer client.Close()
+
+	switch m.TLSMode {
+	case TLSModeStartTLS:
+		ok = run("TLS handshake", func() (string, error) {
+			if ok, _ := client.Extension("STARTTLS"); !ok {
+				return "", errors.New("server doesn't support STARTTLS, use implicit TLS or no TLS")
+			}
+			err := client.StartTLS(tlsConfig)
+			if err != nil {
+				return "", fmt.Errorf("STARTTLS failed: %v", err)
+			}
+			state, _ := client.TLSConnectionState()
+			return describeTLS(state), nil
+		})
+		if !ok {
+			return steps
+		}
+	case TLSModeNone:
+		skip("TLS handshake", "TLS is disabled, the connection isn't encrypted")
+	}
+
+	if m.Username == "" {
+		skip("Authentication", "no username is set")
+	} else if ok, _ := client.Extension("AUTH"); !ok {
+		skip("Authentication", "the server doesn't offer authentication, the username and password are not used")
+	} else {
+		ok = run("Authentication", func() (string, error) {
+			err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+			if err != nil {
+				return "", fmt.Errorf("authentication failed: %v", err)
+			}
+			return "logged in as " + m.Username, nil
+		})
+		if !ok {
+			return steps
+		}
+	}
+
+	run("Test email", func() (string, error) {
+		msg := &Message{
+			From:    TernaryIf(m.From != "", m.From, m.Username),
+			ReplyTo: m.ReplyTo,
+			To:      []string{to},
+			Subject: "Test email",
+			Text: "This is a test email sent from the admin page of " + Env.BASE_URL + " to check the SMTP settings.\n\n" +
+				"If you're reading this, emails are delivered.",
+		}
+		from, rcpts, err := msg.envelope()
+		if err != nil {
+			return "", err
+		}
+		response, err := deliver(client, from, rcpts, msg)
+		if err != nil {
+			return "", err
+		}
+		return "sent to " + to + ", the server replied " + response, nil
+	})
+	return steps
+}
+
+// Describes the negotiated TLS version, cipher suite and server certificate.
+func describeTLS(state tls.ConnectionState) string {
+	detail := tls.VersionName(state.Version) + " with " + tls.CipherSuiteName(state.CipherSuite)
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		detail += fmt.Sprintf(", certificate for %s valid until %s", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02"))
+	}
+	return detail
+}
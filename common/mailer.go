@@ -1,11 +1,25 @@
 package common
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/mail"
 	"net/smtp"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -20,13 +34,21 @@ import (
 // if the mailer is configured before sending an email and if not, return an error.
 //
 // Another important thing to note is that whenever the user changes the mailer configuration,
-// we will need to update the database & re-instantiate the mailer.
+// we will need to update the database & re-instantiate the mailer. NewMailer does both, so always
+// change the configuration with it (or ReloadMailer if the database was changed some other way).
+// Emails are sent with the mailer that's current when they're delivered, so queued emails use the new settings.
 //
 // This is a tradeoff we are willing to make to optimize for self-hosting.
 
-var Mailer *MailerT
 var MailDb *sqlx.DB
 
+// The current mailer, nil if it's not configured. Readers load it without locking,
+// writers hold mailerMu so the database and the mailer are changed together.
+var (
+	mailer   atomic.Pointer[MailerT]
+	mailerMu sync.Mutex
+)
+
 func init() {
 	var err error
 	MailDb, err = sqlx.Open("sqlite3", "./db/mail.db")
@@ -51,30 +73,203 @@ func init() {
 		host TEXT,
 		port INTEGER,
 		username TEXT,
-		password TEXT
+		password TEXT,
+		tls_mode TEXT NOT NULL DEFAULT 'starttls',
+		tls_skip_verify INTEGER NOT NULL DEFAULT 0,
+		ca_file TEXT NOT NULL DEFAULT '',
+		from_address TEXT NOT NULL DEFAULT '',
+		reply_to TEXT NOT NULL DEFAULT ''
 	)`)
 	if err != nil {
 		log.Fatalf("Error creating mailer_config table: %v", err)
 	}
 
+	// migrate tables created by older versions
+	migrations := []struct{ column, definition string }{
+		{"tls_mode", "TEXT NOT NULL DEFAULT 'starttls'"},
+		{"tls_skip_verify", "INTEGER NOT NULL DEFAULT 0"},
+		{"ca_file", "TEXT NOT NULL DEFAULT ''"},
+		{"from_address", "TEXT NOT NULL DEFAULT ''"},
+		{"reply_to", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, m := range migrations {
+		err = AddColumnIfMissing(MailDb, "mailer_config", m.column, m.definition)
+		if err != nil {
+			log.Fatalf("Error migrating mailer_config table: %v", err)
+		}
+	}
+	RegisterSecretColumn(MailDb, "mailer_config", "password")
+
+	_, err = MailDb.Exec(`
+	CREATE TABLE IF NOT EXISTS mail_settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Error creating mail_settings table: %v", err)
+	}
+
+	_, err = MailDb.Exec(`
+	CREATE TABLE IF NOT EXISTS mailbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender TEXT NOT NULL,
+		recipients TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		raw BLOB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatalf("Error creating mailbox table: %v", err)
+	}
+
+	_, err = MailDb.Exec(`
+	CREATE TABLE IF NOT EXISTS outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		recipients TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		raw BLOB NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		response TEXT NOT NULL DEFAULT '',
+		transport TEXT NOT NULL DEFAULT '',
+		template TEXT NOT NULL DEFAULT '',
+		next_attempt_at INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		sent_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS outbox_status_next_attempt_at ON outbox (status, next_attempt_at);`)
+	if err != nil {
+		log.Fatalf("Error creating outbox table: %v", err)
+	}
+	err = AddColumnIfMissing(MailDb, "outbox", "template", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		log.Fatalf("Error migrating outbox table: %v", err)
+	}
+	// used to count the messages sent in the windows of the rate limits
+	_, err = MailDb.Exec(`CREATE INDEX IF NOT EXISTS outbox_sent_at ON outbox (sent_at)`)
+	if err != nil {
+		log.Fatalf("Error creating outbox index: %v", err)
+	}
+	// used to match the bounces with the messages they're about
+	_, err = MailDb.Exec(`CREATE INDEX IF NOT EXISTS outbox_message_id ON outbox (message_id)`)
+	if err != nil {
+		log.Fatalf("Error creating outbox index: %v", err)
+	}
+	err = loadRateLimits()
+	if err != nil {
+		log.Printf("Error loading rate limits: %v", err)
+	}
+
+	_, err = MailDb.Exec(`
+	CREATE TABLE IF NOT EXISTS dkim_config (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		enabled INTEGER NOT NULL DEFAULT 0,
+		domain TEXT NOT NULL,
+		selector TEXT NOT NULL,
+		algorithm TEXT NOT NULL,
+		private_key TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Error creating dkim_config table: %v", err)
+	}
+	RegisterSecretColumn(MailDb, "dkim_config", "private_key")
+
+	// every row is a version of an email template, see emailtemplate.go
+	_, err = MailDb.Exec(`
+	CREATE TABLE IF NOT EXISTS email_templates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		html TEXT NOT NULL,
+		text TEXT NOT NULL,
+		edited_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS email_templates_name ON email_templates (name, id);`)
+	if err != nil {
+		log.Fatalf("Error creating email_templates table: %v", err)
+	}
+
+	_, err = MailDb.Exec(`
+	CREATE TABLE IF NOT EXISTS suppressions (
+		email TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Error creating suppressions table: %v", err)
+	}
+}
+
+// Loads the mail settings saved in the database: the DKIM key, the transport and the mailer.
+// Call it when the app starts, after LoadEnv: the secrets key and MAIL_TRANSPORT come from the environment.
+func LoadMailSettings() error {
+	err := ReloadDKIM()
+	if err != nil {
+		log.Printf("Error loading DKIM settings: %v", err)
+	}
+
+	err = loadTransport()
+	if err != nil {
+		return fmt.Errorf("failed to load the mail transport: %v", err)
+	}
+
 	// Load the mailer configuration from the database
-	// If the mailer is not configured, we will just return
-	err = MailDb.Get(&Mailer, "SELECT * FROM mailer_config LIMIT 1")
+	// If the mailer is not configured, it stays nil
+	err = ReloadMailer()
 	if err != nil {
-		log.Printf("Error getting mailer configuration: %v", err)
-		return
+		log.Printf("Error loading mailer configuration: %v", err)
+	}
+	return nil
+}
+
+// Returns a copy of the current mailer, or nil if it's not configured.
+// Example:
+//
+//	if m := GetMailer(); m != nil {
+//		log.Printf("Sending emails with %s", m.Host)
+//	}
+func GetMailer() *MailerT {
+	current := mailer.Load()
+	if current == nil {
+		return nil
 	}
+	config := *current
+	return &config
+}
+
+// Loads the mailer configuration from the database and makes it the current mailer.
+// The mailer is unset if there's no configuration.
+func ReloadMailer() error {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
 
-	Mailer = &MailerT{
-		Host:     Mailer.Host,
-		Port:     Mailer.Port,
-		Username: Mailer.Username,
-		Password: Mailer.Password,
+	var config MailerT
+	err := MailDb.Get(&config, `SELECT host, port, username, password, tls_mode, tls_skip_verify, ca_file, from_address, reply_to FROM mailer_config LIMIT 1`)
+	if err == sql.ErrNoRows {
+		mailer.Store(nil)
+		return nil
+	}
+	if err != nil {
+		return err
 	}
+	config.Password, err = DecryptSecret(config.Password)
+	if err != nil {
+		return fmt.Errorf("can't decrypt SMTP password: %v", err)
+	}
+	mailer.Store(&config)
+	return nil
 }
 
-// Updates the mailer configuration in the database
-// and instantiates the new mailer.
+// Updates the mailer configuration in the database and makes it the current mailer,
+// the next email is sent with it. The configuration isn't validated, use ValidateMailer first.
 // Example:
 //
 //	NewMailer(&MailerT{
@@ -82,60 +277,297 @@ func init() {
 //		Port:     587,
 //		Username: "username",
 //		Password: "password",
+//		TLSMode:  TLSModeStartTLS,
+//		From:     "App <app@example.com>",
 //	})
 func NewMailer(config *MailerT) error {
-	_, err := MailDb.Exec(`
-	INSERT INTO mailer_config (id, host, port, username, password) VALUES (1, ?, ?, ?, ?)
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+
+	password, err := EncryptSecret(config.Password)
+	if err != nil {
+		return err
+	}
+	_, err = MailDb.Exec(`
+	INSERT INTO mailer_config (id, host, port, username, password, tls_mode, tls_skip_verify, ca_file, from_address, reply_to) VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(id) DO UPDATE SET
 	host = excluded.host,
 	port = excluded.port,
 	username = excluded.username,
-	password = excluded.password`, config.Host, config.Port, config.Username, config.Password)
+	password = excluded.password,
+	tls_mode = excluded.tls_mode,
+	tls_skip_verify = excluded.tls_skip_verify,
+	ca_file = excluded.ca_file,
+	from_address = excluded.from_address,
+	reply_to = excluded.reply_to`,
+		config.Host, config.Port, config.Username, password, config.TLSMode, config.TLSSkipVerify, config.CAFile, config.From, config.ReplyTo)
 	if err != nil {
 		return err
 	}
-	Mailer = &MailerT{
-		Host:     Mailer.Host,
-		Port:     Mailer.Port,
-		Username: Mailer.Username,
-		Password: Mailer.Password,
-	}
+
+	mailer.Store(config.clone())
 	return nil
 }
 
+// Returns a deep copy, so changing the config afterwards doesn't change the mailer.
+// Strings are copied too: the ones read from a fiber request point to a buffer that's reused after the request.
+func (m *MailerT) clone() *MailerT {
+	config := *m
+	for _, s := range []*string{&config.Host, &config.Username, &config.Password, &config.TLSMode, &config.CAFile, &config.From, &config.ReplyTo} {
+		*s = strings.Clone(*s)
+	}
+	return &config
+}
+
 func IsValidMailer(config *MailerT) bool {
+	return ValidateMailer(config) == nil
+}
+
+var hostnameRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Same as IsValidMailer, but returns an error explaining why the configuration is invalid.
+// Hostnames are resolved, so this can take a few seconds if the DNS server is slow.
+func ValidateMailer(config *MailerT) error {
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+
+	// the hostname must resolve
+	if net.ParseIP(config.Host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupHost(ctx, config.Host)
+		if err != nil || len(addrs) == 0 {
+			return fmt.Errorf("can't resolve %s", config.Host)
+		}
+	}
+	return nil
+}
+
+// Checks the format of the configuration, without any network access.
+func (config *MailerT) validate() error {
 	// basic existence check
 	if config.Host == "" || config.Port == 0 || config.Username == "" || config.Password == "" {
-		return false
+		return errors.New("host, port, username and password are required")
 	}
 
-	// is Host a valid IP address
-	if net.ParseIP(config.Host) == nil {
-		return false
+	// Host must be an IP address or a hostname
+	if net.ParseIP(config.Host) == nil && (len(config.Host) > 253 || !hostnameRegex.MatchString(config.Host)) {
+		return fmt.Errorf("%s is not a valid hostname or IP address", config.Host)
 	}
 
 	// check if the port is valid (1-65535)
 	if config.Port < 1 || config.Port > 65535 {
-		return false
+		return errors.New("port must be between 1 and 65535")
+	}
+
+	if !slices.Contains(TLSModes, config.TLSMode) {
+		return fmt.Errorf("TLS mode must be one of %s", strings.Join(TLSModes, ", "))
 	}
 
-	return true
+	// the sender defaults to the username, which isn't always an email address
+	if config.From == "" {
+		_, err := mail.ParseAddress(config.Username)
+		if err != nil {
+			return errors.New("a From address is required when the username isn't an email address")
+		}
+	} else {
+		_, err := mail.ParseAddress(config.From)
+		if err != nil || checkHeaderValue("From", config.From) != nil {
+			return fmt.Errorf("%s is not a valid From address", config.From)
+		}
+	}
+	if config.ReplyTo != "" {
+		_, err := mail.ParseAddress(config.ReplyTo)
+		if err != nil || checkHeaderValue("Reply-To", config.ReplyTo) != nil {
+			return fmt.Errorf("%s is not a valid Reply-To address", config.ReplyTo)
+		}
+	}
+
+	// make sure the CA bundle can be used before saving it
+	if config.CAFile != "" {
+		_, err := config.tlsConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
+// How the connection to the SMTP server is encrypted.
+const (
+	TLSModeNone     = "none"     // Plain text, only for local relays. Most servers refuse to authenticate without TLS.
+	TLSModeStartTLS = "starttls" // Connect in plain text and upgrade with STARTTLS, fail if the server doesn't support it. Usually port 587.
+	TLSModeTLS      = "tls"      // Implicit TLS from the start of the connection. Usually port 465.
+)
+
+var TLSModes = []string{TLSModeNone, TLSModeStartTLS, TLSModeTLS}
+
 type MailerT struct {
-	Host     string // The hostname of the SMTP server
-	Port     int    // The port number of the SMTP server
-	Username string // The username to use for authentication
-	Password string // The password to use for authentication
+	Host          string `db:"host"`            // The hostname or IP address of the SMTP server
+	Port          int    `db:"port"`            // The port number of the SMTP server
+	Username      string `db:"username"`        // The username to use for authentication
+	Password      string `db:"password"`        // The password to use for authentication, encrypted in the database (see secrets.go)
+	TLSMode       string `db:"tls_mode"`        // One of TLSModes
+	TLSSkipVerify bool   `db:"tls_skip_verify"` // Don't verify the server certificate (e.g. self-signed). Avoid in production.
+	CAFile        string `db:"ca_file"`         // Path to a PEM bundle of CA certificates to trust instead of the system ones
+	From          string `db:"from_address"`    // Default sender, e.g. `App <app@example.com>`. Falls back to the username.
+	ReplyTo       string `db:"reply_to"`        // Default Reply-To address, optional
+}
+
+// Builds the TLS configuration used for STARTTLS and implicit TLS.
+func (m *MailerT) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         m.Host,
+		InsecureSkipVerify: m.TLSSkipVerify,
+	}
+	if m.CAFile != "" {
+		pem, err := os.ReadFile(m.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", m.CAFile)
+		}
+	}
+	return config, nil
 }
 
-// Sends an email to the specified recipient(s) with the specified subject and body.
+// Connects to the SMTP server, encrypts the connection according to the TLS mode
+// and authenticates. The caller must close the client.
+func (m *MailerT) dial() (*smtp.Client, error) {
+	tlsConfig, err := m.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if m.TLSMode == TLSModeTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+
+	if m.TLSMode == TLSModeStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, errors.New("server doesn't support STARTTLS, use implicit TLS or no TLS")
+		}
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+
+	if ok, _ := client.Extension("AUTH"); ok && m.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	return client, nil
+}
+
+// Sends a plain text email to the specified recipient(s) with the specified subject and body.
 func (m *MailerT) SendMail(to []string, subject, body string) error {
-	auth := smtp.PlainAuth("", m.Username, m.Password, m.Host)
-	msg := []byte("To: " + strings.Join(to, ",") + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"\r\n" +
-		body + "\r\n")
-	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
-	return smtp.SendMail(addr, auth, m.Username, to, msg)
+	return m.Send(&Message{
+		To:      to,
+		Subject: subject,
+		Text:    body,
+	})
+}
+
+// Sends the message, using the configured From and Reply-To addresses if it doesn't set its own.
+func (m *MailerT) Send(msg *Message) error {
+	_, err := m.SendWithResponse(msg)
+	return err
+}
+
+// Same as Send, and returns the final response of the server, which usually contains the queue ID
+// of the message (e.g. `250 2.0.0 OK queued as 4F1B2C`).
+func (m *MailerT) SendWithResponse(msg *Message) (string, error) {
+	if msg.From == "" {
+		msg.From = TernaryIf(m.From != "", m.From, m.Username)
+	}
+	if msg.ReplyTo == "" {
+		msg.ReplyTo = m.ReplyTo
+	}
+	from, to, err := msg.envelope()
+	if err != nil {
+		return "", err
+	}
+	return m.send(from, to, msg)
+}
+
+// Delivers a message to the recipients over a new SMTP connection.
+// The message is streamed to the server, if writing it fails the transaction is aborted.
+// Errors returned by the server wrap a *textproto.Error with the SMTP reply code.
+func (m *MailerT) send(from string, to []string, msg io.WriterTo) (string, error) {
+	client, err := m.dial()
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	return deliver(client, from, to, msg)
+}
+
+// Runs the mail transaction on an open SMTP session and quits it once the message is accepted.
+func deliver(client *smtp.Client, from string, to []string, msg io.WriterTo) (string, error) {
+	err := client.Mail(from)
+	if err != nil {
+		return "", fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+	for _, addr := range to {
+		err = client.Rcpt(addr)
+		if err != nil {
+			return "", fmt.Errorf("RCPT TO %s failed: %w", addr, err)
+		}
+	}
+
+	// DATA is sent by hand because smtp.Client discards the final response
+	id, err := client.Text.Cmd("DATA")
+	if err != nil {
+		return "", fmt.Errorf("DATA failed: %w", err)
+	}
+	client.Text.StartResponse(id)
+	_, _, err = client.Text.ReadResponse(354)
+	client.Text.EndResponse(id)
+	if err != nil {
+		return "", fmt.Errorf("DATA failed: %w", err)
+	}
+	w := client.Text.DotWriter()
+	_, err = msg.WriteTo(w)
+	if err != nil {
+		// closing the connection without the final dot makes the server drop the message
+		return "", fmt.Errorf("failed to write message: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write message: %w", err)
+	}
+	code, response, err := client.Text.ReadResponse(250)
+	if err != nil {
+		return "", fmt.Errorf("message rejected: %w", err)
+	}
+
+	// the message is accepted, a failed QUIT doesn't matter
+	client.Quit()
+	return fmt.Sprintf("%d %s", code, response), nil
 }
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// This file parses raw emails (the ones we write in message.go, or received ones like bounces)
+// into their headers, bodies and attachments.
+
+// An email parsed by ParseMessage.
+type ParsedMessage struct {
+	Header      mail.Header
+	From        string
+	To          string
+	Subject     string // Decoded, can contain any UTF-8 characters
+	Date        time.Time
+	Text        string // First text/plain part that isn't an attachment
+	HTML        string // First text/html part that isn't an attachment
+	Attachments []ParsedAttachment
+}
+
+// An attachment, inline image or any other part of a ParsedMessage that isn't a text body.
+type ParsedAttachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string // Without the angle brackets
+	Data        []byte
+}
+
+// Parses a raw email. Bodies are decoded from quoted-printable and base64, multipart
+// messages are walked recursively. Text is assumed to be UTF-8.
+func ParseMessage(r io.Reader) (*ParsedMessage, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+
+	decoder := &mime.WordDecoder{}
+	decode := func(s string) string {
+		decoded, err := decoder.DecodeHeader(s)
+		if err != nil {
+			return s
+		}
+		return decoded
+	}
+	parsed := &ParsedMessage{
+		Header:  msg.Header,
+		From:    decode(msg.Header.Get("From")),
+		To:      decode(msg.Header.Get("To")),
+		Subject: decode(msg.Header.Get("Subject")),
+	}
+	parsed.Date, _ = msg.Header.Date()
+
+	err = parsed.addEntity(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	if err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// Adds the body of an entity to the message, walking into multipart entities.
+func (p *ParsedMessage) addEntity(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	// messages are never nested this deep, unless they're crafted to make us recurse forever
+	if depth > 10 {
+		return fmt.Errorf("too many nested parts")
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid multipart body: %v", err)
+			}
+			err = p.addEntity(part.Header, part, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("failed to decode %s part: %v", mediaType, err)
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	isAttachment := disposition == "attachment"
+	switch {
+	case mediaType == "text/plain" && !isAttachment && p.Text == "":
+		p.Text = string(data)
+	case mediaType == "text/html" && !isAttachment && p.HTML == "":
+		p.HTML = string(data)
+	default:
+		p.Attachments = append(p.Attachments, ParsedAttachment{
+			Filename:    TernaryIf(dispositionParams["filename"] != "", dispositionParams["filename"], params["name"]),
+			ContentType: mediaType,
+			ContentID:   strings.Trim(header.Get("Content-ID"), "<>"),
+			Data:        data,
+		})
+	}
+	return nil
+}
+
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	}
+	return r
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The package opens its databases in ./db when it's initialized, so the tests run in a temporary
+// directory. Package variables are set before any init function runs, which makes this work.
+var testDir = func() string {
+	dir, err := os.MkdirTemp("", "common-test")
+	if err != nil {
+		log.Fatalf("Error creating the test directory: %v", err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "db"), 0o755)
+	if err != nil {
+		log.Fatalf("Error creating the test database directory: %v", err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		log.Fatalf("Error moving to the test directory: %v", err)
+	}
+	return dir
+}()
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// Returns a lookup function for EnvOptions reading the given variables.
+func lookupMap(vars map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := vars[key]
+		return value, ok
+	}
+}
+
+// Returns the description of an environment variable, or fails the test if it's missing.
+func findEnvVarInfo(t *testing.T, infos []EnvVarInfo, name string) EnvVarInfo {
+	t.Helper()
+	for _, info := range infos {
+		if info.Name == name {
+			return info
+		}
+	}
+	t.Fatalf("%s isn't described", name)
+	return EnvVarInfo{}
+}
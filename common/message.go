@@ -0,0 +1,365 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+)
+
+// This file builds RFC 5322 email messages (headers, MIME structure and encodings)
+// so the rest of the codebase only has to describe what to send.
+// Every header value is checked for line breaks, which prevents header injection
+// when a subject or an address comes from user input.
+
+// Describes an email to send. The mailer fills From and Reply-To from its configuration when they're empty.
+// Example:
+//
+//	err := SendMessage(&Message{
+//		To:      []string{"jane@example.com"},
+//		Subject: "Welcome!",
+//		Text:    "Thanks for signing up.",
+//	})
+//
+// Set HTML (or render a templ component with SetHTML) to send a multipart/alternative message,
+// the text part is then generated from the HTML unless Text is set too.
+type Message struct {
+	From    string    // Sender address, e.g. `App <app@example.com>`
+	ReplyTo string    // Optional address replies should go to
+	To      []string  // Recipient addresses
+	Subject string    // Subject line, can contain any UTF-8 characters
+	Text    string    // Plain text body, generated from HTML if empty
+	HTML    string    // Optional HTML body
+	Date    time.Time // Defaults to the time the message is written
+	ID      string    // Message-ID without the angle brackets, generated if empty
+
+	// Kind of email, e.g. "password_reset". It isn't part of the message: it's saved in the outbox,
+	// shown in the delivery log and used by the per-template rate limit.
+	Template string
+
+	Attachments        []Attachment // Files attached to the message and images embedded in the HTML, see Attach and Embed
+	MaxAttachmentsSize int64        // Total size limit of the attachments in bytes. Default: DefaultMaxAttachmentsSize
+
+	raw []byte // The message as already written, when it's loaded from the outbox
+}
+
+// Checks every header value and parses the addresses.
+// Returns the sender address and the recipient addresses to use for the SMTP envelope.
+func (m *Message) envelope() (string, []string, error) {
+	if m.From == "" {
+		return "", nil, fmt.Errorf("message has no sender")
+	}
+	// the address parser accepts folded lines, so check for line breaks first
+	for _, header := range [][2]string{{"From", m.From}, {"Reply-To", m.ReplyTo}, {"To", strings.Join(m.To, ",")}, {"Subject", m.Subject}, {"Message-ID", m.ID}} {
+		err := checkHeaderValue(header[0], header[1])
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid From address %q: %v", m.From, err)
+	}
+	if m.ReplyTo != "" {
+		_, err = mail.ParseAddress(m.ReplyTo)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid Reply-To address %q: %v", m.ReplyTo, err)
+		}
+	}
+	if len(m.To) == 0 {
+		return "", nil, fmt.Errorf("message has no recipients")
+	}
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid To address %q: %v", addr, err)
+		}
+		to[i] = parsed.Address
+	}
+	err = m.checkAttachments()
+	if err != nil {
+		return "", nil, err
+	}
+	return from.Address, to, nil
+}
+
+// Writes the message in the RFC 5322 format with CRLF line endings, signed with DKIM if it's enabled.
+// Attachments are read and encoded on the fly, so they're never fully held in memory,
+// unless the message is signed: the signature covers the whole message, which is written to memory first.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	_, _, err := m.envelope()
+	if err != nil {
+		return 0, err
+	}
+	if m.raw != nil {
+		n, err := w.Write(m.raw)
+		return int64(n), err
+	}
+
+	signer := currentDKIMSigner()
+	if signer == nil {
+		return m.writeUnsigned(w)
+	}
+	var b bytes.Buffer
+	_, err = m.writeUnsigned(&b)
+	if err != nil {
+		return 0, err
+	}
+	signature, err := signer.Sign(b.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: w}
+	_, err = io.WriteString(cw, signature)
+	if err == nil {
+		_, err = cw.Write(b.Bytes())
+	}
+	return cw.n, err
+}
+
+// Writes the message without a DKIM signature.
+func (m *Message) writeUnsigned(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	m.writeHeaders(bw)
+
+	body := m.bodyEntity()
+	for _, key := range sortedKeys(body.header) {
+		writeHeader(bw, key, body.header.Get(key))
+	}
+	bw.WriteString("\r\n")
+	err := body.write(bw)
+	if err != nil {
+		return cw.n, err
+	}
+	err = bw.Flush()
+	return cw.n, err
+}
+
+// Renders a templ component (usually wrapped in EmailLayout) as the HTML body.
+// Example:
+//
+//	msg := &Message{To: []string{email}, Subject: "Password Reset"}
+//	err := msg.SetHTML(ctx, forgot_password_email(resetURL))
+func (m *Message) SetHTML(ctx context.Context, component templ.Component) error {
+	var b strings.Builder
+	err := component.Render(ctx, &b)
+	if err != nil {
+		return fmt.Errorf("failed to render email: %v", err)
+	}
+	m.HTML = b.String()
+	return nil
+}
+
+// A MIME entity: its content headers and a function that writes its encoded content.
+type mimeEntity struct {
+	header textproto.MIMEHeader
+	write  func(w io.Writer) error
+}
+
+// Builds the MIME tree of the message. The most complete message looks like:
+//
+//	multipart/mixed
+//	├── multipart/related
+//	│   ├── multipart/alternative
+//	│   │   ├── text/plain
+//	│   │   └── text/html
+//	│   └── inline images
+//	└── attachments
+//
+// and every level that isn't needed is left out.
+func (m *Message) bodyEntity() mimeEntity {
+	budget := &attachmentBudget{limit: m.maxAttachmentsSize(), remaining: m.maxAttachmentsSize()}
+	var inline, attached []mimeEntity
+	for _, a := range m.Attachments {
+		if a.ContentID != "" {
+			inline = append(inline, a.entity(budget))
+		} else {
+			attached = append(attached, a.entity(budget))
+		}
+	}
+
+	var body mimeEntity
+	if m.HTML == "" {
+		body = textEntity("text/plain; charset=UTF-8", m.Text)
+	} else {
+		text := m.Text
+		if text == "" {
+			text = HTMLToText(m.HTML)
+		}
+		// the HTML part goes last because clients display the last part they support
+		body = multipartEntity("alternative",
+			textEntity("text/plain; charset=UTF-8", text),
+			textEntity("text/html; charset=UTF-8", m.HTML),
+		)
+	}
+	if len(inline) > 0 {
+		body = multipartEntity("related", append([]mimeEntity{body}, inline...)...)
+	}
+	if len(attached) > 0 {
+		body = multipartEntity("mixed", append([]mimeEntity{body}, attached...)...)
+	}
+	return body
+}
+
+// A text part encoded with quoted-printable, which keeps lines short and ASCII-only.
+func textEntity(contentType string, body string) mimeEntity {
+	return mimeEntity{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		write: func(w io.Writer) error {
+			qp := quotedprintable.NewWriter(w)
+			_, err := qp.Write([]byte(body))
+			if err != nil {
+				return err
+			}
+			err = qp.Close()
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, "\r\n")
+			return err
+		},
+	}
+}
+
+// A multipart entity (mixed, alternative or related) containing the given parts.
+func multipartEntity(subtype string, parts ...mimeEntity) mimeEntity {
+	boundary := newBoundary()
+	return mimeEntity{
+		header: textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary})},
+		},
+		write: func(w io.Writer) error {
+			mw := multipart.NewWriter(w)
+			err := mw.SetBoundary(boundary)
+			if err != nil {
+				return err
+			}
+			for _, part := range parts {
+				pw, err := mw.CreatePart(part.header)
+				if err != nil {
+					return err
+				}
+				err = part.write(pw)
+				if err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		},
+	}
+}
+
+// Returns the message in the RFC 5322 format.
+func (m *Message) Bytes() ([]byte, error) {
+	var b bytes.Buffer
+	_, err := m.WriteTo(&b)
+	return b.Bytes(), err
+}
+
+// Writes the headers common to every message, everything but the content headers.
+func (m *Message) writeHeaders(w *bufio.Writer) {
+	from, _ := mail.ParseAddress(m.From)
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+	if m.ID == "" {
+		m.ID = newMessageID(from.Address)
+	}
+
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		parsed, _ := mail.ParseAddress(addr)
+		to[i] = parsed.String()
+	}
+
+	writeHeader(w, "From", from.String())
+	writeHeader(w, "To", strings.Join(to, ", "))
+	if m.ReplyTo != "" {
+		replyTo, _ := mail.ParseAddress(m.ReplyTo)
+		writeHeader(w, "Reply-To", replyTo.String())
+	}
+	writeHeader(w, "Subject", mime.QEncoding.Encode("UTF-8", m.Subject))
+	writeHeader(w, "Date", m.Date.Format(time.RFC1123Z))
+	writeHeader(w, "Message-ID", "<"+m.ID+">")
+	writeHeader(w, "MIME-Version", "1.0")
+}
+
+// Returns an error if a header value contains a line break, which could be used to inject headers.
+func checkHeaderValue(name string, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%s header can't contain line breaks", name)
+	}
+	return nil
+}
+
+// Writes a header line, folding it at spaces so lines stay under 78 characters when possible.
+func writeHeader(w *bufio.Writer, name string, value string) {
+	line := name + ":"
+	for _, word := range strings.Split(value, " ") {
+		if len(line)+1+len(word) > 76 && strings.TrimSpace(line) != name+":" {
+			w.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	w.WriteString(line + "\r\n")
+}
+
+// Generates a random multipart boundary. Quoted-printable and base64 never produce `=_`,
+// so the boundary can't collide with the encoded content.
+func newBoundary() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "=_" + hex.EncodeToString(b)
+}
+
+// Returns the keys of the header in alphabetical order, to write them in a stable order.
+func sortedKeys(header textproto.MIMEHeader) []string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Generates a unique Message-ID in the domain of the sender.
+func newMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at != -1 {
+		domain = from[at+1:]
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+// Counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMessageEnvelope(t *testing.T) {
+	valid := func() Message {
+		return Message{
+			From:    "App <app@example.com>",
+			ReplyTo: "support@example.com",
+			To:      []string{"Jane <jane@example.com>", "john@example.org"},
+			Subject: "Welcome!",
+			ID:      "123.abc@example.com",
+		}
+	}
+	tests := []struct {
+		name     string
+		edit     func(m *Message)
+		wantFrom string
+		wantTo   []string
+		wantErr  string
+	}{
+		{
+			name:     "valid",
+			edit:     func(m *Message) {},
+			wantFrom: "app@example.com",
+			wantTo:   []string{"jane@example.com", "john@example.org"},
+		},
+		{
+			name:    "LF in the subject",
+			edit:    func(m *Message) { m.Subject = "Hello\nBcc: victim@example.net" },
+			wantErr: "Subject header can't contain line breaks",
+		},
+		{
+			name:    "CR in the subject",
+			edit:    func(m *Message) { m.Subject = "Hello\rBcc: victim@example.net" },
+			wantErr: "Subject header can't contain line breaks",
+		},
+		{
+			name:    "folded From address",
+			edit:    func(m *Message) { m.From = "App\r\n <app@example.com>" },
+			wantErr: "From header can't contain line breaks",
+		},
+		{
+			name:    "CRLF in a recipient",
+			edit:    func(m *Message) { m.To = []string{"jane@example.com\r\nBcc: victim@example.net"} },
+			wantErr: "To header can't contain line breaks",
+		},
+		{
+			name:    "LF in the Reply-To address",
+			edit:    func(m *Message) { m.ReplyTo = "support@example.com\nBcc: victim@example.net" },
+			wantErr: "Reply-To header can't contain line breaks",
+		},
+		{
+			name:    "CR in the Message-ID",
+			edit:    func(m *Message) { m.ID = "123.abc@example.com\r" },
+			wantErr: "Message-ID header can't contain line breaks",
+		},
+		{
+			name:    "no sender",
+			edit:    func(m *Message) { m.From = "" },
+			wantErr: "message has no sender",
+		},
+		{
+			name:    "no recipients",
+			edit:    func(m *Message) { m.To = nil },
+			wantErr: "message has no recipients",
+		},
+		{
+			name:    "invalid recipient",
+			edit:    func(m *Message) { m.To = []string{"jane"} },
+			wantErr: `invalid To address "jane"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid()
+			tt.edit(&m)
+			from, to, err := m.envelope()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				_, err = m.WriteTo(io.Discard)
+				if err == nil {
+					t.Errorf("the message was written anyway")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if from != tt.wantFrom || !slices.Equal(to, tt.wantTo) {
+				t.Errorf("got envelope %q %q, want %q %q", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+)
+
+// This file makes sending emails durable. Every message is written to the outbox table
+// of the mail database before it's delivered, and the outcome of every attempt is saved there:
+// the outbox is also the delivery log shown in the admin page.
+//
+// A message goes through these statuses:
+//
+//	queued -> sending -> sent
+//	   ^         |
+//	   +---------+ (temporary error, retried later)
+//	             |
+//	             +----> failed (permanent error or too many attempts)
+//	             |
+//	             +----> dropped (over a rate limit, see ratelimit.go)
+//	             |
+//	             +----> suppressed (every recipient bounced or complained, see bounce.go)
+//
+// The message itself is saved in the row as written, so it's sent exactly as it was queued.
+// Its size is bounded by the attachments limit (see Message.MaxAttachmentsSize), and the rows of
+// finished messages are deleted after MAIL_LOG_RETENTION, so the outbox doesn't grow forever.
+//
+// Messages are claimed with an atomic update before being sent, so they're never sent
+// twice at the same time. If the app stops while a message is being sent, it's sent
+// again on the next start: delivery is at least once.
+
+const (
+	OutboxQueued     = "queued"
+	OutboxSending    = "sending"
+	OutboxSent       = "sent"
+	OutboxFailed     = "failed"
+	OutboxDropped    = "dropped"
+	OutboxSuppressed = "suppressed"
+)
+
+var OutboxStatuses = []string{OutboxQueued, OutboxSending, OutboxSent, OutboxFailed, OutboxDropped, OutboxSuppressed}
+
+// How long to wait before each retry. A message is marked as failed after the last one.
+var OutboxRetryDelays = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour}
+
+// Returned when a message isn't sent because it isn't ready to be: it's already sent or being sent,
+// or its next attempt isn't due yet. The outbox sends it later if it's still queued.
+var ErrQueued = errors.New("message not sent now")
+
+// A message in the outbox and the outcome of its delivery.
+type OutboxEntry struct {
+	ID            int64        `db:"id"`
+	MessageID     string       `db:"message_id"` // Message-ID header, without the angle brackets
+	Sender        string       `db:"sender"`     // Envelope sender
+	Recipients    string       `db:"recipients"` // Envelope recipients, comma-separated
+	Subject       string       `db:"subject"`
+	Raw           []byte       `db:"raw"`
+	Status        string       `db:"status"` // One of OutboxStatuses
+	Attempts      int          `db:"attempts"`
+	LastError     string       `db:"last_error"` // Error of the last failed attempt
+	Response      string       `db:"response"`   // Response of the provider when the message was accepted
+	Transport     string       `db:"transport"`  // Transport used for the last attempt
+	Template      string       `db:"template"`   // Kind of email, see Message.Template
+	NextAttemptAt int64        `db:"next_attempt_at"`
+	CreatedAt     time.Time    `db:"created_at"`
+	UpdatedAt     time.Time    `db:"updated_at"`
+	SentAt        sql.NullTime `db:"sent_at"`
+}
+
+var outboxQueue *Queue
+
+// Starts sending the messages of the outbox in the background. Call it once when the app starts.
+// Messages that were being sent when the app stopped are queued again.
+func StartOutbox() {
+	_, err := MailDb.Exec(`UPDATE outbox SET status = ? WHERE status = ?`, OutboxQueued, OutboxSending)
+	if err != nil {
+		log.Printf("Error requeuing outbox messages: %v", err)
+	}
+
+	outboxQueue = NewQueue(QueueOptions{Workers: 2})
+	outboxQueue.StartJobQueue()
+
+	// pick up retries and messages that didn't fit in the queue
+	go func() {
+		for {
+			scheduleDueMessages()
+			time.Sleep(15 * time.Second)
+		}
+	}()
+
+	// keep the delivery log to MAIL_LOG_RETENTION
+	go func() {
+		for {
+			deleted, err := deleteOldOutboxEntries()
+			if err != nil {
+				log.Printf("Error deleting old outbox messages: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Deleted %d outbox messages older than %s", deleted, Env.MAIL_LOG_RETENTION)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// Deletes the finished messages (sent, failed, dropped or suppressed) older than MAIL_LOG_RETENTION.
+// Messages still in a rate limit window are kept, since the limits count them.
+func deleteOldOutboxEntries() (int64, error) {
+	if Env.MAIL_LOG_RETENTION <= 0 {
+		return 0, nil
+	}
+	limits := GetRateLimits()
+	keep := max(Env.MAIL_LOG_RETENTION, limits.RecipientWindow, limits.TemplateWindow, time.Minute)
+	res, err := MailDb.Exec(`DELETE FROM outbox WHERE status IN (?, ?, ?, ?) AND updated_at < ?`,
+		OutboxSent, OutboxFailed, OutboxDropped, OutboxSuppressed, time.Now().UTC().Add(-keep))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func scheduleDueMessages() {
+	var ids []int64
+	err := MailDb.Select(&ids, `SELECT id FROM outbox WHERE status = ? AND next_attempt_at <= ? ORDER BY id LIMIT 100`,
+		OutboxQueued, time.Now().Unix())
+	if err != nil {
+		log.Printf("Error getting outbox messages: %v", err)
+		return
+	}
+	for _, id := range ids {
+		scheduleOutboxEntry(id)
+	}
+}
+
+func scheduleOutboxEntry(id int64) {
+	if outboxQueue == nil {
+		return // the outbox isn't started, the message will wait
+	}
+	outboxQueue.AddJob(Job{
+		Name: fmt.Sprintf("send-outbox-message-%d", id),
+		Func: func() error {
+			err := deliverOutboxEntry(id)
+			if errors.Is(err, ErrQueued) {
+				return nil // another worker took it, or a retry is scheduled
+			}
+			return err
+		},
+	})
+}
+
+// Adds the message to the outbox and returns right away, it's sent in the background.
+// If the message doesn't set From or Reply-To, the ones from the SMTP settings are used, or MAIL_FROM for the sender.
+// Example:
+//
+//	id, err := QueueMessage(&Message{To: []string{email}, Subject: "Hello", Text: "Hi!"})
+func QueueMessage(msg *Message) (int64, error) {
+	id, err := addToOutbox(msg)
+	if err != nil {
+		return 0, err
+	}
+	scheduleOutboxEntry(id)
+	return id, nil
+}
+
+// Adds the message to the outbox and sends it right away. If sending fails, the error is
+// returned and the message stays in the outbox to be retried, unless the error is permanent.
+// A message that isn't sent because of a rate limit, of suppressed recipients, or because the outbox
+// took it first returns an ErrRateLimited, ErrSuppressed or ErrQueued error: nil means the message was sent.
+// Prefer QueueMessage in request handlers, so the response doesn't wait for the mail server.
+// Example:
+//
+//	err := SendMessage(&Message{To: []string{email}, Subject: "Hello", Text: "Hi!"})
+func SendMessage(msg *Message) error {
+	id, err := addToOutbox(msg)
+	if err != nil {
+		return err
+	}
+	return deliverOutboxEntry(id)
+}
+
+// Writes the message and saves it in the outbox. Errors in the message itself
+// (invalid address, attachment too big...) are returned here, before anything is queued.
+func addToOutbox(msg *Message) (int64, error) {
+	if msg.From == "" {
+		msg.From = defaultFrom()
+	}
+	if m := GetMailer(); msg.ReplyTo == "" && m != nil {
+		msg.ReplyTo = m.ReplyTo
+	}
+	from, to, err := msg.envelope()
+	if err != nil {
+		return 0, err
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	res, err := MailDb.Exec(`INSERT INTO outbox (message_id, sender, recipients, subject, raw, status, template, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.ID, from, strings.Join(to, ", "), msg.Subject, raw, OutboxQueued, msg.Template, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add message to the outbox: %v", err)
+	}
+	return res.LastInsertId()
+}
+
+// Claims the message, checks the rate limits, sends it with the current transport and saves the outcome.
+// Returns the error of the attempt, if any, or an ErrQueued, ErrRateLimited or ErrSuppressed error
+// if the message isn't sent, so nil always means it was sent.
+func deliverOutboxEntry(id int64) error {
+	entry, claimed, err := claimOutboxEntry(id)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return fmt.Errorf("%w: message %d", ErrQueued, id)
+	}
+
+	t, transportName := CurrentTransport()
+	msg := entry.message()
+	var response string
+	if rt, ok := t.(ResponseTransport); ok {
+		response, err = rt.SendWithResponse(msg)
+	} else {
+		err = t.Send(msg)
+	}
+
+	now := time.Now().UTC()
+	if err == nil {
+		_, dbErr := MailDb.Exec(`UPDATE outbox SET status = ?, response = ?, last_error = '', transport = ?, sent_at = ?, updated_at = ? WHERE id = ?`,
+			OutboxSent, response, transportName, now, now, id)
+		if dbErr != nil {
+			log.Printf("Error saving outbox message %d as sent: %v", id, dbErr)
+		}
+		return nil
+	}
+
+	status, nextAttempt := OutboxFailed, int64(0)
+	if !isPermanentMailError(err) && entry.Attempts <= len(OutboxRetryDelays) {
+		status, nextAttempt = OutboxQueued, now.Add(OutboxRetryDelays[entry.Attempts-1]).Unix()
+	}
+	_, dbErr := MailDb.Exec(`UPDATE outbox SET status = ?, last_error = ?, transport = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?`,
+		status, err.Error(), transportName, nextAttempt, now, id)
+	if dbErr != nil {
+		log.Printf("Error saving outbox message %d as %s: %v", id, status, dbErr)
+	}
+	return err
+}
+
+// Marks the message as being sent and returns it, unless it's already sent, being sent, or not due yet.
+// Suppressed recipients are removed from the returned entry. A message without recipients left,
+// or over a rate limit, is marked as such here and isn't claimed.
+func claimOutboxEntry(id int64) (OutboxEntry, bool, error) {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	var entry OutboxEntry
+	now := time.Now().UTC()
+	res, err := MailDb.Exec(`UPDATE outbox SET status = ?, attempts = attempts + 1, updated_at = ?
+	WHERE id = ? AND status = ? AND next_attempt_at <= ?`, OutboxSending, now, id, OutboxQueued, now.Unix())
+	if err != nil {
+		return entry, false, fmt.Errorf("failed to claim outbox message %d: %v", id, err)
+	}
+	if claimed, _ := res.RowsAffected(); claimed == 0 {
+		return entry, false, nil
+	}
+
+	err = MailDb.Get(&entry, `SELECT * FROM outbox WHERE id = ?`, id)
+	if err != nil {
+		return entry, false, fmt.Errorf("failed to get outbox message %d: %v", id, err)
+	}
+
+	recipients := strings.Split(entry.Recipients, ", ")
+	suppressions, err := getSuppressions(recipients)
+	if err != nil {
+		log.Printf("Error checking suppressions of outbox message %d: %v", id, err)
+	}
+	if len(suppressions) > 0 {
+		var reasons []string
+		for _, s := range suppressions {
+			recipients = slices.DeleteFunc(recipients, func(r string) bool { return strings.EqualFold(r, s.Email) })
+			reasons = append(reasons, fmt.Sprintf("%s (%s: %s)", s.Email, s.Kind, s.Reason))
+		}
+		if len(recipients) == 0 {
+			reason := "Suppressed: " + strings.Join(reasons, ", ")
+			_, err = MailDb.Exec(`UPDATE outbox SET status = ?, last_error = ?, next_attempt_at = 0, updated_at = ? WHERE id = ?`,
+				OutboxSuppressed, reason, now, id)
+			if err != nil {
+				log.Printf("Error saving outbox message %d as suppressed: %v", id, err)
+			}
+			return entry, false, fmt.Errorf("%w: %s", ErrSuppressed, strings.Join(reasons, ", "))
+		}
+		// the others still get the message, the delivery log keeps every recipient
+		entry.Recipients = strings.Join(recipients, ", ")
+	}
+
+	decision, err := checkRateLimits(entry)
+	if err != nil {
+		// send the message anyway, the limits are a protection and shouldn't block emails
+		log.Printf("Error checking rate limits of outbox message %d: %v", id, err)
+		return entry, true, nil
+	}
+	if decision == nil {
+		return entry, true, nil
+	}
+
+	// a message deferred again and again (say an address flooded with password resets) is given up on
+	if decision.action == RateLimitDefer && decision.retryAt.Sub(entry.CreatedAt) > RateLimitMaxDefer {
+		decision.action = RateLimitDrop
+		decision.reason = fmt.Sprintf("deferred for more than %g hours, %s", RateLimitMaxDefer.Hours(), decision.reason)
+	}
+
+	// a deferred message didn't really try to send, so it doesn't use one of its retries
+	if decision.action == RateLimitDefer {
+		_, err = MailDb.Exec(`UPDATE outbox SET status = ?, attempts = attempts - 1, last_error = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?`,
+			OutboxQueued, "Deferred: "+decision.reason, decision.retryAt.Unix(), now, id)
+	} else {
+		_, err = MailDb.Exec(`UPDATE outbox SET status = ?, last_error = ?, next_attempt_at = 0, updated_at = ? WHERE id = ?`,
+			OutboxDropped, "Dropped: "+decision.reason, now, id)
+	}
+	if err != nil {
+		log.Printf("Error saving outbox message %d as rate limited: %v", id, err)
+	}
+	return entry, false, fmt.Errorf("%w: %s", ErrRateLimited, decision.reason)
+}
+
+// Returns the message to send for the entry, written exactly as when it was queued.
+func (e OutboxEntry) message() *Message {
+	return &Message{
+		From:    e.Sender,
+		To:      strings.Split(e.Recipients, ", "),
+		Subject: e.Subject,
+		ID:      e.MessageID,
+		raw:     e.Raw,
+	}
+}
+
+// Returns whether retrying can't help: the server rejected the message with a 5xx reply,
+// or the message itself is invalid.
+func isPermanentMailError(err error) bool {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	return errors.Is(err, ErrAttachmentsTooBig)
+}
+
+// Filters for SearchOutbox, empty fields match everything.
+type OutboxFilter struct {
+	Query  string // Matched against the recipients, the sender, the subject, the Message-ID and the template
+	Status string // One of OutboxStatuses
+	Limit  int    // Maximum number of entries to return. Default: 100
+}
+
+// Returns the entries of the outbox matching the filter, newest first, without their raw message.
+func SearchOutbox(filter OutboxFilter) ([]OutboxEntry, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	query := `SELECT id, message_id, sender, recipients, subject, status, attempts, last_error, response, transport, template,
+	next_attempt_at, created_at, updated_at, sent_at FROM outbox WHERE 1 = 1`
+	var args []any
+	if filter.Query != "" {
+		like := "%" + escapeLike(filter.Query) + "%"
+		query += ` AND (recipients LIKE ? ESCAPE '\' OR sender LIKE ? ESCAPE '\' OR subject LIKE ? ESCAPE '\' OR message_id LIKE ? ESCAPE '\' OR template LIKE ? ESCAPE '\')`
+		args = append(args, like, like, like, like, like)
+	}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, filter.Status)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, filter.Limit)
+
+	var entries []OutboxEntry
+	err := MailDb.Select(&entries, query, args...)
+	return entries, err
+}
+
+// Returns an entry of the outbox with its raw message.
+func GetOutboxEntry(id int64) (OutboxEntry, error) {
+	var entry OutboxEntry
+	err := MailDb.Get(&entry, `SELECT * FROM outbox WHERE id = ?`, id)
+	return entry, err
+}
+
+// Queues a copy of an outbox entry, with the same content, and returns the ID of the copy.
+// The original entry is kept as is in the log.
+func ResendOutboxEntry(id int64) (int64, error) {
+	entry, err := GetOutboxEntry(id)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	res, err := MailDb.Exec(`INSERT INTO outbox (message_id, sender, recipients, subject, raw, status, template, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.MessageID, entry.Sender, entry.Recipients, entry.Subject, entry.Raw, OutboxQueued, entry.Template, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add message to the outbox: %v", err)
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	scheduleOutboxEntry(newID)
+	return newID, nil
+}
@@ -0,0 +1,244 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// A transport failing with the given error, or sending nothing and succeeding if it's nil.
+type errorTransport struct {
+	err error
+}
+
+func (t errorTransport) Send(msg *Message) error {
+	return t.err
+}
+
+// Sends the messages of the test with the given transport.
+func useTestTransport(t *testing.T, tr MailTransport) {
+	t.Helper()
+	previous, previousName := CurrentTransport()
+	UseTransport("test", tr)
+	t.Cleanup(func() { UseTransport(previousName, previous) })
+}
+
+// Checks the messages of the test against the given limits.
+func useTestRateLimits(t *testing.T, limits RateLimits) {
+	t.Helper()
+	previous := GetRateLimits()
+	rateLimits.Store(&limits)
+	t.Cleanup(func() { rateLimits.Store(&previous) })
+}
+
+// Adds a message to the outbox without sending it, then applies the given changes to its row.
+// Each test gets its own recipient, so the rate limits and suppressions of one don't affect another.
+func addTestOutboxEntry(t *testing.T, to string, set string, args ...any) int64 {
+	t.Helper()
+	id, err := addToOutbox(&Message{From: "app@example.com", To: []string{to}, Subject: "Test", Text: "Hello"})
+	if err != nil {
+		t.Fatalf("failed to add the message: %v", err)
+	}
+	if set != "" {
+		_, err = MailDb.Exec(`UPDATE outbox SET `+set+` WHERE id = ?`, append(args, id)...)
+		if err != nil {
+			t.Fatalf("failed to update the message: %v", err)
+		}
+	}
+	return id
+}
+
+func getTestOutboxEntry(t *testing.T, id int64) OutboxEntry {
+	t.Helper()
+	entry, err := GetOutboxEntry(id)
+	if err != nil {
+		t.Fatalf("failed to get message %d: %v", id, err)
+	}
+	return entry
+}
+
+func TestClaimOutboxEntry(t *testing.T) {
+	useTestRateLimits(t, RateLimits{})
+	tests := []struct {
+		name        string
+		set         string
+		args        []any
+		wantClaimed bool
+	}{
+		{name: "queued", wantClaimed: true},
+		{name: "retry due", set: "attempts = 1, next_attempt_at = ?", args: []any{time.Now().Add(-time.Minute).Unix()}, wantClaimed: true},
+		{name: "retry not due", set: "attempts = 1, next_attempt_at = ?", args: []any{time.Now().Add(time.Minute).Unix()}},
+		{name: "being sent", set: "status = ?", args: []any{OutboxSending}},
+		{name: "sent", set: "status = ?", args: []any{OutboxSent}},
+		{name: "failed", set: "status = ?", args: []any{OutboxFailed}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := addTestOutboxEntry(t, fmt.Sprintf("claim-%d@example.com", i), tt.set, tt.args...)
+			before := getTestOutboxEntry(t, id)
+
+			entry, claimed, err := claimOutboxEntry(id)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if claimed != tt.wantClaimed {
+				t.Fatalf("got claimed %v, want %v", claimed, tt.wantClaimed)
+			}
+			after := getTestOutboxEntry(t, id)
+			if !claimed {
+				if after.Status != before.Status || after.Attempts != before.Attempts {
+					t.Errorf("unclaimed message changed from %s (%d attempts) to %s (%d attempts)",
+						before.Status, before.Attempts, after.Status, after.Attempts)
+				}
+				return
+			}
+			if after.Status != OutboxSending || after.Attempts != before.Attempts+1 || entry.Attempts != after.Attempts {
+				t.Errorf("got %s with %d attempts, want %s with %d", after.Status, after.Attempts, OutboxSending, before.Attempts+1)
+			}
+
+			// a message is only claimed once
+			_, claimed, err = claimOutboxEntry(id)
+			if err != nil || claimed {
+				t.Errorf("claimed twice (error %v)", err)
+			}
+		})
+	}
+}
+
+func TestDeliverOutboxEntry(t *testing.T) {
+	useTestRateLimits(t, RateLimits{})
+	temporary := &textproto.Error{Code: 451, Msg: "4.3.0 try again later"}
+	permanent := &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+	tests := []struct {
+		name          string
+		attempts      int // Attempts before this one
+		err           error
+		wantStatus    string
+		wantNextDelay time.Duration // Delay of the next attempt, if it's retried
+	}{
+		{name: "sent", wantStatus: OutboxSent},
+		{name: "temporary SMTP error", err: temporary, wantStatus: OutboxQueued, wantNextDelay: OutboxRetryDelays[0]},
+		{name: "connection error", err: errors.New("dial tcp: connection refused"), wantStatus: OutboxQueued, wantNextDelay: OutboxRetryDelays[0]},
+		{name: "second retry", attempts: 1, err: temporary, wantStatus: OutboxQueued, wantNextDelay: OutboxRetryDelays[1]},
+		{name: "last retry", attempts: len(OutboxRetryDelays) - 1, err: temporary, wantStatus: OutboxQueued, wantNextDelay: OutboxRetryDelays[len(OutboxRetryDelays)-1]},
+		{name: "too many attempts", attempts: len(OutboxRetryDelays), err: temporary, wantStatus: OutboxFailed},
+		{name: "permanent SMTP error", err: permanent, wantStatus: OutboxFailed},
+		{name: "wrapped permanent SMTP error", err: fmt.Errorf("authentication failed: %w", permanent), wantStatus: OutboxFailed},
+		{name: "attachments too big", err: fmt.Errorf("%w: 30 MB", ErrAttachmentsTooBig), wantStatus: OutboxFailed},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestTransport(t, errorTransport{tt.err})
+			id := addTestOutboxEntry(t, fmt.Sprintf("deliver-%d@example.com", i), "attempts = ?", tt.attempts)
+
+			start := time.Now()
+			err := deliverOutboxEntry(id)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			entry := getTestOutboxEntry(t, id)
+			if entry.Status != tt.wantStatus {
+				t.Fatalf("got status %s, want %s (last error %q)", entry.Status, tt.wantStatus, entry.LastError)
+			}
+			if entry.Attempts != tt.attempts+1 {
+				t.Errorf("got %d attempts, want %d", entry.Attempts, tt.attempts+1)
+			}
+			if entry.Transport != "test" {
+				t.Errorf("got transport %q, want test", entry.Transport)
+			}
+
+			switch tt.wantStatus {
+			case OutboxSent:
+				if !entry.SentAt.Valid || entry.LastError != "" {
+					t.Errorf("got sent at %v and last error %q", entry.SentAt, entry.LastError)
+				}
+			case OutboxQueued:
+				next := time.Unix(entry.NextAttemptAt, 0)
+				if next.Before(start.Add(tt.wantNextDelay).Truncate(time.Second)) || next.After(time.Now().Add(tt.wantNextDelay)) {
+					t.Errorf("next attempt in %s, want %s", time.Until(next).Round(time.Second), tt.wantNextDelay)
+				}
+				fallthrough
+			case OutboxFailed:
+				if entry.LastError != tt.err.Error() {
+					t.Errorf("got last error %q, want %q", entry.LastError, tt.err.Error())
+				}
+			}
+
+			// a message that isn't queued anymore, or isn't due yet, isn't sent again
+			err = deliverOutboxEntry(id)
+			if !errors.Is(err, ErrQueued) {
+				t.Errorf("delivering again returned %v, want ErrQueued", err)
+			}
+		})
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	useTestRateLimits(t, RateLimits{})
+	recorder := &MemoryTransport{}
+	useTestTransport(t, recorder)
+
+	err := SendMessage(&Message{From: "app@example.com", To: []string{"send@example.com"}, Subject: "Hello", Text: "Hi!", Template: "welcome"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sent := recorder.Messages()
+	if len(sent) != 1 || sent[0].To[0] != "send@example.com" {
+		t.Fatalf("got %d messages sent, want 1 to send@example.com", len(sent))
+	}
+	entries, err := SearchOutbox(OutboxFilter{Query: "send@example.com"})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %d entries (error %v), want 1", len(entries), err)
+	}
+	if entries[0].Status != OutboxSent || entries[0].Template != "welcome" || entries[0].Subject != "Hello" {
+		t.Errorf("got entry %+v", entries[0])
+	}
+
+	// the message is sent exactly as it was saved in the outbox
+	entry := getTestOutboxEntry(t, entries[0].ID)
+	if string(entry.Raw) != string(sent[0].Raw) {
+		t.Errorf("the message sent differs from the one saved:\n%s\n---\n%s", sent[0].Raw, entry.Raw)
+	}
+}
+
+func TestDeleteOldOutboxEntries(t *testing.T) {
+	useTestRateLimits(t, RateLimits{RecipientWindow: time.Hour, TemplateWindow: time.Hour})
+	previous := Env.MAIL_LOG_RETENTION
+	Env.MAIL_LOG_RETENTION = 24 * time.Hour
+	t.Cleanup(func() { Env.MAIL_LOG_RETENTION = previous })
+
+	old := time.Now().UTC().Add(-25 * time.Hour)
+	recent := time.Now().UTC().Add(-23 * time.Hour)
+	tests := []struct {
+		status     string
+		updatedAt  time.Time
+		wantDelete bool
+	}{
+		{OutboxSent, old, true},
+		{OutboxFailed, old, true},
+		{OutboxDropped, old, true},
+		{OutboxSuppressed, old, true},
+		{OutboxQueued, old, false},
+		{OutboxSending, old, false},
+		{OutboxSent, recent, false},
+	}
+	ids := make([]int64, len(tests))
+	for i, tt := range tests {
+		ids[i] = addTestOutboxEntry(t, fmt.Sprintf("retention-%d@example.com", i), "status = ?, updated_at = ?", tt.status, tt.updatedAt)
+	}
+
+	_, err := deleteOldOutboxEntries()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, tt := range tests {
+		_, err := GetOutboxEntry(ids[i])
+		if deleted := errors.Is(err, sql.ErrNoRows); deleted != tt.wantDelete {
+			t.Errorf("%s message updated %s ago: got deleted %v, want %v (error %v)",
+				tt.status, time.Since(tt.updatedAt).Round(time.Hour), deleted, tt.wantDelete, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This file throttles outgoing emails, so a form like "forgot password" can't be used
+// to flood an inbox or to burn the sending reputation of the server.
+//
+// There are three limits, checked when a message of the outbox is about to be sent:
+//   - a global cap on the emails sent per minute, which always defers messages
+//   - a cap on the emails sent to one recipient over a rolling window
+//   - a cap on the emails sent with one template (see Message.Template) over a rolling window
+//
+// Messages over the recipient or template caps are deferred or dropped, depending on RateLimits.Action.
+// A message isn't deferred past RateLimitMaxDefer after it was queued, it's dropped instead, so a flood
+// of requests for one address can't pile up messages that wait forever.
+// The sent messages are counted from the outbox, and the decision is saved there so it shows
+// in the delivery log. The limits are saved in the mail_settings table and changed in the admin page.
+
+const (
+	RateLimitDefer = "defer" // Send the message once the window has room for it
+	RateLimitDrop  = "drop"  // Don't send the message
+)
+
+// Returned when sending a message is deferred or dropped because of a limit.
+var ErrRateLimited = errors.New("rate limited")
+
+// How long after it was queued a message can still be deferred by a limit. Past it, the message is dropped.
+var RateLimitMaxDefer = 24 * time.Hour
+
+// The limits on outgoing emails. A limit of 0 disables it.
+type RateLimits struct {
+	PerMinute       int           // Emails sent per minute, to anyone
+	PerRecipient    int           // Emails sent to one address per RecipientWindow
+	RecipientWindow time.Duration // Rolling window of PerRecipient
+	PerTemplate     int           // Emails sent with one template per TemplateWindow
+	TemplateWindow  time.Duration // Rolling window of PerTemplate
+	Action          string        // What happens to messages over the recipient or template limits: RateLimitDefer or RateLimitDrop
+}
+
+var DefaultRateLimits = RateLimits{
+	PerMinute:       60,
+	PerRecipient:    5,
+	RecipientWindow: time.Hour,
+	PerTemplate:     300,
+	TemplateWindow:  time.Hour,
+	Action:          RateLimitDrop,
+}
+
+var (
+	rateLimits atomic.Pointer[RateLimits]
+	// Held while a message is claimed and checked, so two workers can't both take the last spot of a window.
+	rateLimitMu sync.Mutex
+)
+
+// Returns the current limits.
+func GetRateLimits() RateLimits {
+	if limits := rateLimits.Load(); limits != nil {
+		return *limits
+	}
+	return DefaultRateLimits
+}
+
+// Validates and saves the limits, they apply to the next messages sent.
+func SetRateLimits(limits RateLimits) error {
+	if limits.PerMinute < 0 || limits.PerRecipient < 0 || limits.PerTemplate < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if limits.RecipientWindow < time.Minute || limits.TemplateWindow < time.Minute {
+		return errors.New("windows must be at least 1 minute")
+	}
+	if limits.Action != RateLimitDefer && limits.Action != RateLimitDrop {
+		return fmt.Errorf("action must be %s or %s", RateLimitDefer, RateLimitDrop)
+	}
+
+	tx, err := MailDb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, value := range limits.settings() {
+		_, err = tx.Exec(`INSERT INTO mail_settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, value)
+		if err != nil {
+			return fmt.Errorf("failed to save the rate limits: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to save the rate limits: %v", err)
+	}
+	// the action can come from a fiber request, which reuses its buffer after the request
+	limits.Action = strings.Clone(limits.Action)
+	rateLimits.Store(&limits)
+	return nil
+}
+
+// Loads the limits from the database, missing ones keep their default value.
+func loadRateLimits() error {
+	var rows []struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	err := MailDb.Select(&rows, `SELECT key, value FROM mail_settings WHERE key LIKE 'rate_limit_%'`)
+	if err != nil {
+		return err
+	}
+	limits := DefaultRateLimits
+	for _, row := range rows {
+		var err error
+		switch row.Key {
+		case "rate_limit_per_minute":
+			limits.PerMinute, err = strconv.Atoi(row.Value)
+		case "rate_limit_per_recipient":
+			limits.PerRecipient, err = strconv.Atoi(row.Value)
+		case "rate_limit_recipient_window":
+			limits.RecipientWindow, err = time.ParseDuration(row.Value)
+		case "rate_limit_per_template":
+			limits.PerTemplate, err = strconv.Atoi(row.Value)
+		case "rate_limit_template_window":
+			limits.TemplateWindow, err = time.ParseDuration(row.Value)
+		case "rate_limit_action":
+			limits.Action = row.Value
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", row.Key, err)
+		}
+	}
+	rateLimits.Store(&limits)
+	return nil
+}
+
+// Returns the limits as mail_settings rows.
+func (l RateLimits) settings() map[string]string {
+	return map[string]string{
+		"rate_limit_per_minute":       strconv.Itoa(l.PerMinute),
+		"rate_limit_per_recipient":    strconv.Itoa(l.PerRecipient),
+		"rate_limit_recipient_window": l.RecipientWindow.String(),
+		"rate_limit_per_template":     strconv.Itoa(l.PerTemplate),
+		"rate_limit_template_window":  l.TemplateWindow.String(),
+		"rate_limit_action":           l.Action,
+	}
+}
+
+// What to do with a message that hit a limit.
+type rateLimitDecision struct {
+	action  string    // RateLimitDefer or RateLimitDrop
+	reason  string    // Which limit was hit, for the delivery log
+	retryAt time.Time // When the window has room again, for deferred messages
+}
+
+// Checks the limits for a claimed outbox entry. Returns nil if the message can be sent.
+// The entry itself is excluded from the counts, since it's being sent.
+func checkRateLimits(entry OutboxEntry) (*rateLimitDecision, error) {
+	limits := GetRateLimits()
+	now := time.Now().UTC()
+
+	if limits.PerMinute > 0 {
+		retryAt, hit, err := windowIsFull(entry.ID, limits.PerMinute, time.Minute, now, "", nil)
+		if err != nil || hit {
+			return &rateLimitDecision{RateLimitDefer, fmt.Sprintf("global limit of %d emails per minute reached", limits.PerMinute), retryAt}, err
+		}
+	}
+
+	if limits.PerRecipient > 0 {
+		for _, recipient := range strings.Split(entry.Recipients, ", ") {
+			like := "%, " + escapeLike(strings.ToLower(recipient)) + ", %"
+			retryAt, hit, err := windowIsFull(entry.ID, limits.PerRecipient, limits.RecipientWindow, now,
+				`AND LOWER(', ' || recipients || ', ') LIKE ? ESCAPE '\'`, []any{like})
+			if err != nil || hit {
+				return &rateLimitDecision{limits.Action, fmt.Sprintf("limit of %d emails to %s per %s reached",
+					limits.PerRecipient, recipient, formatWindow(limits.RecipientWindow)), retryAt}, err
+			}
+		}
+	}
+
+	if limits.PerTemplate > 0 && entry.Template != "" {
+		retryAt, hit, err := windowIsFull(entry.ID, limits.PerTemplate, limits.TemplateWindow, now,
+			`AND template = ?`, []any{entry.Template})
+		if err != nil || hit {
+			return &rateLimitDecision{limits.Action, fmt.Sprintf("limit of %d %s emails per %s reached",
+				limits.PerTemplate, entry.Template, formatWindow(limits.TemplateWindow)), retryAt}, err
+		}
+	}
+	return nil, nil
+}
+
+// Returns whether limit messages matching the condition were sent (or are being sent) in the window
+// ending now, and if so when the oldest of them leaves the window.
+func windowIsFull(id int64, limit int, window time.Duration, now time.Time, condition string, args []any) (time.Time, bool, error) {
+	query := `FROM outbox WHERE id != ? AND ((status = 'sent' AND sent_at >= ?) OR (status = 'sending' AND updated_at >= ?)) ` + condition
+	args = append([]any{id, now.Add(-window), now.Add(-window)}, args...)
+
+	var count int
+	err := MailDb.Get(&count, `SELECT COUNT(*) `+query, args...)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to check rate limits: %v", err)
+	}
+	if count < limit {
+		return time.Time{}, false, nil
+	}
+
+	// the window has room again when the oldest message in it is older than the window
+	var oldest struct {
+		SentAt    sql.NullTime `db:"sent_at"`
+		UpdatedAt time.Time    `db:"updated_at"`
+	}
+	err = MailDb.Get(&oldest, `SELECT sent_at, updated_at `+query+` ORDER BY COALESCE(sent_at, updated_at) LIMIT 1`, args...)
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("failed to check rate limits: %v", err)
+	}
+	sentAt := oldest.UpdatedAt
+	if oldest.SentAt.Valid {
+		sentAt = oldest.SentAt.Time
+	}
+	return sentAt.Add(window + time.Second), true, nil
+}
+
+// Formats a window for humans, e.g. "hour" or "30m0s".
+func formatWindow(window time.Duration) string {
+	switch window {
+	case time.Minute:
+		return "minute"
+	case time.Hour:
+		return "hour"
+	case 24 * time.Hour:
+		return "day"
+	}
+	return window.String()
+}
+
+// Escapes the wildcards of a LIKE pattern, to use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
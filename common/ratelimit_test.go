@@ -0,0 +1,154 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClaimOutboxEntryRateLimits(t *testing.T) {
+	type sentMessage struct {
+		to       string
+		template string
+		ago      time.Duration
+	}
+	tests := []struct {
+		name       string
+		limits     RateLimits
+		sent       []sentMessage // Messages sent before
+		to         string
+		template   string
+		queuedAgo  time.Duration
+		wantStatus string // Empty if the message is claimed
+		wantError  string // Prefix of the last error
+		wantRetry  time.Duration
+	}{
+		{
+			name:   "under the recipient limit",
+			limits: RateLimits{PerRecipient: 2, RecipientWindow: time.Hour, Action: RateLimitDrop},
+			sent:   []sentMessage{{to: "under@example.com", ago: time.Minute}},
+			to:     "under@example.com",
+		},
+		{
+			name:       "recipient limit dropped",
+			limits:     RateLimits{PerRecipient: 1, RecipientWindow: time.Hour, Action: RateLimitDrop},
+			sent:       []sentMessage{{to: "drop@example.com", ago: time.Minute}},
+			to:         "drop@example.com",
+			wantStatus: OutboxDropped,
+			wantError:  "Dropped: limit of 1 emails to drop@example.com per hour reached",
+		},
+		{
+			name:       "recipient limit deferred",
+			limits:     RateLimits{PerRecipient: 1, RecipientWindow: time.Hour, Action: RateLimitDefer},
+			sent:       []sentMessage{{to: "defer@example.com", ago: 10 * time.Minute}},
+			to:         "defer@example.com",
+			wantStatus: OutboxQueued,
+			wantError:  "Deferred: limit of 1 emails to defer@example.com per hour reached",
+			wantRetry:  50 * time.Minute,
+		},
+		{
+			name:       "recipient compared without case",
+			limits:     RateLimits{PerRecipient: 1, RecipientWindow: time.Hour, Action: RateLimitDrop},
+			sent:       []sentMessage{{to: "Case@Example.com", ago: time.Minute}},
+			to:         "case@example.com",
+			wantStatus: OutboxDropped,
+			wantError:  "Dropped: limit of 1 emails to case@example.com",
+		},
+		{
+			name:   "wildcards in the recipient escaped",
+			limits: RateLimits{PerRecipient: 1, RecipientWindow: time.Hour, Action: RateLimitDrop},
+			sent:   []sentMessage{{to: "wildxcard@example.com", ago: time.Minute}},
+			to:     "wild_card@example.com",
+		},
+		{
+			name:   "sent before the window",
+			limits: RateLimits{PerRecipient: 1, RecipientWindow: time.Hour, Action: RateLimitDrop},
+			sent:   []sentMessage{{to: "old@example.com", ago: 2 * time.Hour}},
+			to:     "old@example.com",
+		},
+		{
+			name:   "other recipient",
+			limits: RateLimits{PerRecipient: 1, RecipientWindow: time.Hour, Action: RateLimitDrop},
+			sent:   []sentMessage{{to: "someone@example.com", ago: time.Minute}},
+			to:     "someone-else@example.com",
+		},
+		{
+			name:       "template limit dropped",
+			limits:     RateLimits{PerTemplate: 1, TemplateWindow: time.Hour, Action: RateLimitDrop},
+			sent:       []sentMessage{{to: "template-1@example.com", template: "test_reset", ago: time.Minute}},
+			to:         "template-2@example.com",
+			template:   "test_reset",
+			wantStatus: OutboxDropped,
+			wantError:  "Dropped: limit of 1 test_reset emails per hour reached",
+		},
+		{
+			name:     "other template",
+			limits:   RateLimits{PerTemplate: 1, TemplateWindow: time.Hour, Action: RateLimitDrop},
+			sent:     []sentMessage{{to: "template-3@example.com", template: "test_welcome", ago: time.Minute}},
+			to:       "template-4@example.com",
+			template: "test_other",
+		},
+		{
+			name:       "global limit always deferred",
+			limits:     RateLimits{PerMinute: 1, Action: RateLimitDrop},
+			sent:       []sentMessage{{to: "global-1@example.com", ago: 30 * time.Second}},
+			to:         "global-2@example.com",
+			wantStatus: OutboxQueued,
+			wantError:  "Deferred: global limit of 1 emails per minute reached",
+		},
+		{
+			name:       "deferred less than RateLimitMaxDefer after it was queued",
+			limits:     RateLimits{PerRecipient: 1, RecipientWindow: time.Hour, Action: RateLimitDefer},
+			sent:       []sentMessage{{to: "patient@example.com", ago: 30 * time.Minute}},
+			to:         "patient@example.com",
+			queuedAgo:  RateLimitMaxDefer - time.Hour,
+			wantStatus: OutboxQueued,
+			wantError:  "Deferred: limit of 1 emails to patient@example.com",
+			wantRetry:  30 * time.Minute,
+		},
+		{
+			name:       "deferred more than RateLimitMaxDefer after it was queued",
+			limits:     RateLimits{PerRecipient: 1, RecipientWindow: time.Hour, Action: RateLimitDefer},
+			sent:       []sentMessage{{to: "flooded@example.com", ago: 10 * time.Minute}},
+			to:         "flooded@example.com",
+			queuedAgo:  RateLimitMaxDefer,
+			wantStatus: OutboxDropped,
+			wantError:  "Dropped: deferred for more than 24 hours, limit of 1 emails to flooded@example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRateLimits(t, tt.limits)
+			now := time.Now().UTC()
+			for _, sent := range tt.sent {
+				addTestOutboxEntry(t, sent.to, "status = ?, template = ?, sent_at = ?", OutboxSent, sent.template, now.Add(-sent.ago))
+			}
+			id := addTestOutboxEntry(t, tt.to, "template = ?, created_at = ?", tt.template, now.Add(-tt.queuedAgo))
+
+			_, claimed, err := claimOutboxEntry(id)
+			entry := getTestOutboxEntry(t, id)
+			if tt.wantStatus == "" {
+				if err != nil || !claimed {
+					t.Fatalf("not claimed (error %v), got status %s and last error %q", err, entry.Status, entry.LastError)
+				}
+				return
+			}
+			if claimed || !errors.Is(err, ErrRateLimited) {
+				t.Fatalf("got claimed %v and error %v, want an ErrRateLimited error", claimed, err)
+			}
+			if entry.Status != tt.wantStatus || !strings.HasPrefix(entry.LastError, tt.wantError) {
+				t.Errorf("got status %s and last error %q, want %s and %q", entry.Status, entry.LastError, tt.wantStatus, tt.wantError)
+			}
+			if entry.Status == OutboxQueued && entry.Attempts != 0 {
+				t.Errorf("the deferred message used %d attempts", entry.Attempts)
+			}
+			if tt.wantRetry > 0 {
+				retry := time.Unix(entry.NextAttemptAt, 0).Sub(now)
+				if retry < tt.wantRetry || retry > tt.wantRetry+2*time.Second {
+					t.Errorf("retried in %s, want %s", retry, tt.wantRetry)
+				}
+			}
+		})
+	}
+}
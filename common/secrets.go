@@ -0,0 +1,258 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// This file encrypts the secrets we store in the databases (e.g. the SMTP password) with AES-256-GCM,
+// so a copy of ./db isn't enough to read them.
+//
+// The key comes from SECRETS_KEY, or from a key file generated on the first start (SECRETS_KEY_PATH).
+// SECRETS_KEY can hold several comma-separated keys: the first one encrypts, the others only decrypt.
+// To rotate the key, put the new key first, restart (secrets are re-encrypted with it on start,
+// see ReencryptSecrets), then remove the old key.
+//
+// Encrypted values look like `enc:v1:<key id>:<base64 of nonce + ciphertext>`. Values without
+// the prefix are plain text saved by older versions, they're returned as is and encrypted on the next start.
+
+const secretPrefix = "enc:v1:"
+
+type secretKey struct {
+	id   string // First bytes of the SHA-256 of the key, to find the key of a value without trying them all
+	aead cipher.AEAD
+}
+
+var (
+	secretKeysOnce sync.Once
+	secretKeys     []secretKey
+	secretKeysErr  error
+)
+
+// Returns the keys, the one used to encrypt first. They're loaded on first use.
+func getSecretKeys() ([]secretKey, error) {
+	secretKeysOnce.Do(func() {
+		secretKeys, secretKeysErr = loadSecretKeys()
+	})
+	return secretKeys, secretKeysErr
+}
+
+func loadSecretKeys() ([]secretKey, error) {
+	encoded := slices.Clone(Env.SECRETS_KEY)
+	fileKey, err := os.ReadFile(Env.SECRETS_KEY_PATH)
+	switch {
+	case err == nil:
+		// with SECRETS_KEY set, the key file can still decrypt, which makes moving from the file to the env a rotation
+		encoded = append(encoded, strings.TrimSpace(string(fileKey)))
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("can't read secrets key file: %v", err)
+	case len(encoded) == 0:
+		generated, err := generateSecretsKeyFile(Env.SECRETS_KEY_PATH)
+		if err != nil {
+			return nil, err
+		}
+		encoded = []string{generated}
+	}
+
+	var keys []secretKey
+	for i, s := range encoded {
+		raw, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("secrets key %d must be 32 bytes encoded in base64 (e.g. `openssl rand -base64 32`)", i+1)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		keys = append(keys, secretKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+	}
+	return keys, nil
+}
+
+// Creates a key file readable only by the current user and returns the key.
+func generateSecretsKeyFile(path string) (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", fmt.Errorf("can't generate secrets key: %v", err)
+	}
+	key := base64.StdEncoding.EncodeToString(raw)
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return "", fmt.Errorf("can't create secrets key file: %v", err)
+	}
+	// O_EXCL so two processes starting at the same time don't overwrite each other's key
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("can't create secrets key file: %v", err)
+	}
+	_, err = f.WriteString(key + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't write secrets key file: %v", err)
+	}
+	log.Printf("Generated a new secrets key in %s, back it up with the databases: secrets can't be read without it", path)
+	return key, nil
+}
+
+// Encrypts a secret with the current key. Empty secrets stay empty, so "not set" can still be checked.
+// Example:
+//
+//	encrypted, err := EncryptSecret(password)
+func EncryptSecret(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	keys, err := getSecretKeys()
+	if err != nil {
+		return "", err
+	}
+	key := keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("can't generate nonce: %v", err)
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return secretPrefix + key.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a value returned by EncryptSecret, with whichever key encrypted it.
+// Values that aren't encrypted are returned as is.
+func DecryptSecret(value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, secretPrefix)
+	if !ok {
+		return value, nil
+	}
+	id, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", errors.New("invalid encrypted secret")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("invalid encrypted secret")
+	}
+
+	keys, err := getSecretKeys()
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if key.id != id {
+			continue
+		}
+		if len(sealed) < key.aead.NonceSize() {
+			return "", errors.New("invalid encrypted secret")
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		plaintext, err := key.aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return "", errors.New("can't decrypt secret, it was modified or the key is wrong")
+		}
+		return string(plaintext), nil
+	}
+	return "", fmt.Errorf("can't decrypt secret, the key %s that encrypted it isn't in SECRETS_KEY", id)
+}
+
+// Returns whether the value is encrypted with the current key, i.e. doesn't need to be re-encrypted.
+func isCurrentSecret(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	keys, err := getSecretKeys()
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(value, secretPrefix+keys[0].id+":"), nil
+}
+
+type secretColumn struct {
+	db     *sqlx.DB
+	table  string
+	column string
+}
+
+var (
+	secretColumnsMu sync.Mutex
+	secretColumns   []secretColumn
+)
+
+// Declares a column holding values encrypted with EncryptSecret, so ReencryptSecrets can rotate them.
+// Call it when creating the table.
+// Example:
+//
+//	RegisterSecretColumn(MailDb, "mailer_config", "password")
+func RegisterSecretColumn(db *sqlx.DB, table string, column string) {
+	secretColumnsMu.Lock()
+	defer secretColumnsMu.Unlock()
+	secretColumns = append(secretColumns, secretColumn{db: db, table: table, column: column})
+}
+
+// Encrypts the values of the registered columns that are in plain text or encrypted with an old key,
+// and returns how many were updated. It's called when the app starts.
+func ReencryptSecrets() (int, error) {
+	secretColumnsMu.Lock()
+	columns := slices.Clone(secretColumns)
+	secretColumnsMu.Unlock()
+
+	updated := 0
+	for _, col := range columns {
+		var rows []struct {
+			RowID int64  `db:"row_id"`
+			Value string `db:"value"`
+		}
+		err := col.db.Select(&rows, fmt.Sprintf(`SELECT rowid AS row_id, %s AS value FROM %s WHERE %s IS NOT NULL AND %s != ''`,
+			col.column, col.table, col.column, col.column))
+		if err != nil {
+			return updated, fmt.Errorf("failed to get %s.%s: %v", col.table, col.column, err)
+		}
+		for _, row := range rows {
+			current, err := isCurrentSecret(row.Value)
+			if err != nil {
+				return updated, err
+			}
+			if current {
+				continue
+			}
+			plaintext, err := DecryptSecret(row.Value)
+			if err != nil {
+				return updated, fmt.Errorf("%s.%s: %v", col.table, col.column, err)
+			}
+			encrypted, err := EncryptSecret(plaintext)
+			if err != nil {
+				return updated, err
+			}
+			// only replace the value we read, in case it was changed in the meantime
+			_, err = col.db.Exec(fmt.Sprintf(`UPDATE %s SET %s = ? WHERE rowid = ? AND %s = ?`, col.table, col.column, col.column),
+				encrypted, row.RowID, row.Value)
+			if err != nil {
+				return updated, fmt.Errorf("failed to update %s.%s: %v", col.table, col.column, err)
+			}
+			updated++
+		}
+	}
+	return updated, nil
+}
@@ -0,0 +1,161 @@
+package common
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testSecretsKeyA = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testSecretsKeyB = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+// Encrypts the secrets of the test with the given keys, and a key file that doesn't exist yet.
+// Returns the path of the key file.
+func useTestSecretsKeys(t *testing.T, keys ...string) string {
+	t.Helper()
+	previous := Env
+	Env.SECRETS_KEY, Env.SECRETS_KEY_PATH = keys, filepath.Join(t.TempDir(), "secrets.key")
+	secretKeysOnce = sync.Once{}
+	t.Cleanup(func() {
+		Env = previous
+		secretKeysOnce = sync.Once{}
+	})
+	return Env.SECRETS_KEY_PATH
+}
+
+func TestEncryptSecret(t *testing.T) {
+	useTestSecretsKeys(t, testSecretsKeyA)
+
+	encrypted, err := EncryptSecret("hunter2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(encrypted, secretPrefix) || strings.Contains(encrypted, "hunter2") {
+		t.Errorf("got %q, want an encrypted value", encrypted)
+	}
+	again, _ := EncryptSecret("hunter2")
+	if again == encrypted {
+		t.Errorf("the same secret is encrypted to the same value twice")
+	}
+
+	// flip a bit of the ciphertext
+	id, encoded := encrypted[:strings.LastIndex(encrypted, ":")+1], encrypted[strings.LastIndex(encrypted, ":")+1:]
+	sealed, _ := base64.StdEncoding.DecodeString(encoded)
+	sealed[len(sealed)-1] ^= 1
+	modified := id + base64.StdEncoding.EncodeToString(sealed)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{name: "encrypted", value: encrypted, want: "hunter2"},
+		{name: "empty", value: "", want: ""},
+		{name: "plain text of older versions", value: "hunter2", want: "hunter2"},
+		{name: "modified", value: modified, wantErr: "it was modified or the key is wrong"},
+		{name: "unknown key", value: secretPrefix + "00000000:" + encoded, wantErr: "the key 00000000 that encrypted it isn't in SECRETS_KEY"},
+		{name: "truncated", value: secretPrefix + "AAAA", wantErr: "invalid encrypted secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecryptSecret(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %q and error %v, want %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %q and error %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	empty, err := EncryptSecret("")
+	if err != nil || empty != "" {
+		t.Errorf("got %q and error %v for an empty secret", empty, err)
+	}
+}
+
+func TestSecretsKeyFile(t *testing.T) {
+	path := useTestSecretsKeys(t)
+	encrypted, err := EncryptSecret("hunter2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("the key file wasn't generated: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("got key file mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// the key file keeps decrypting once SECRETS_KEY is set
+	secretKeysOnce = sync.Once{}
+	Env.SECRETS_KEY = []string{testSecretsKeyA}
+	got, err := DecryptSecret(encrypted)
+	if err != nil || got != "hunter2" {
+		t.Errorf("got %q and error %v, want hunter2", got, err)
+	}
+}
+
+func TestSecretsKeyInvalid(t *testing.T) {
+	useTestSecretsKeys(t, testSecretsKeyA, "dG9vIHNob3J0")
+	_, err := EncryptSecret("hunter2")
+	if err == nil || !strings.Contains(err.Error(), "secrets key 2 must be 32 bytes") {
+		t.Errorf("got error %v, want the second key to be invalid", err)
+	}
+}
+
+func TestReencryptSecrets(t *testing.T) {
+	_, err := MailDb.Exec(`CREATE TABLE IF NOT EXISTS test_secrets (secret TEXT); DELETE FROM test_secrets`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterSecretColumn(MailDb, "test_secrets", "secret")
+
+	useTestSecretsKeys(t, testSecretsKeyA)
+	oldKey, err := EncryptSecret("old key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = MailDb.Exec(`INSERT INTO test_secrets (secret) VALUES (?), ('plain text'), ('')`, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate: the new key first, the old one only decrypts
+	useTestSecretsKeys(t, testSecretsKeyB, testSecretsKeyA)
+	updated, err := ReencryptSecrets()
+	if err != nil || updated != 2 {
+		t.Fatalf("got %d secrets updated (error %v), want 2", updated, err)
+	}
+	updated, err = ReencryptSecrets()
+	if err != nil || updated != 0 {
+		t.Errorf("got %d secrets updated again (error %v), want 0", updated, err)
+	}
+
+	// the old key can be removed
+	useTestSecretsKeys(t, testSecretsKeyB)
+	var values []string
+	err = MailDb.Select(&values, `SELECT secret FROM test_secrets ORDER BY rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"old key", "plain text", ""} {
+		got, err := DecryptSecret(values[i])
+		if err != nil || got != want {
+			t.Errorf("got %q and error %v, want %q", got, err, want)
+		}
+		if current, _ := isCurrentSecret(values[i]); !current {
+			t.Errorf("%q isn't encrypted with the new key", want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file decouples building emails from delivering them. The code that sends emails
+// calls SendMessage or QueueMessage (see outbox.go), which hand the message to the current MailTransport:
+//   - smtp: the SMTP server configured in the admin page (see mailer.go)
+//   - sendmail: a local sendmail binary (postfix, exim, msmtp...)
+//   - file: saves every message as an .eml file, to inspect them or feed them to another tool
+//   - memory: keeps the messages in memory, to check them in tests
+//   - mailbox: saves the messages in the mail database, to read them at /dev/mailbox (see mailbox.go)
+//
+// The transport is chosen with the MAIL_TRANSPORT env var, or in the admin page if it's not set.
+// In development the mailbox is used unless MAIL_TRANSPORT says otherwise, so no email leaves the machine.
+
+// Delivers messages to their recipients.
+type MailTransport interface {
+	Send(msg *Message) error
+}
+
+// Optionally implemented by transports that get a response when delivering a message
+// (e.g. the queue ID given by the SMTP server). The outbox saves it in the delivery log.
+type ResponseTransport interface {
+	MailTransport
+	SendWithResponse(msg *Message) (string, error)
+}
+
+const (
+	TransportSMTP     = "smtp"
+	TransportSendmail = "sendmail"
+	TransportFile     = "file"
+	TransportMemory   = "memory"
+	TransportMailbox  = "mailbox"
+)
+
+var Transports = []string{TransportSMTP, TransportSendmail, TransportFile, TransportMemory, TransportMailbox}
+
+var (
+	transport     MailTransport = smtpTransport{}
+	transportName               = TransportSMTP
+	transportMu   sync.RWMutex
+)
+
+// Returns a new transport of the given kind, configured from the environment.
+func NewTransport(name string) (MailTransport, error) {
+	switch name {
+	case TransportSMTP:
+		return smtpTransport{}, nil
+	case TransportSendmail:
+		return &SendmailTransport{Path: Env.SENDMAIL_PATH}, nil
+	case TransportFile:
+		return &FileTransport{Dir: Env.MAIL_DIR}, nil
+	case TransportMemory:
+		return &MemoryTransport{}, nil
+	case TransportMailbox:
+		return MailboxTransport{}, nil
+	}
+	return nil, fmt.Errorf("unknown mail transport %q, must be one of %s", name, strings.Join(Transports, ", "))
+}
+
+// Returns the transport used by SendMessage and its name.
+func CurrentTransport() (MailTransport, string) {
+	transportMu.RLock()
+	defer transportMu.RUnlock()
+	return transport, transportName
+}
+
+// Replaces the transport used by SendMessage, e.g. with a MemoryTransport in tests.
+// Example:
+//
+//	recorder := &MemoryTransport{}
+//	UseTransport(TransportMemory, recorder)
+//	// ...trigger the email...
+//	sent := recorder.Messages()
+func UseTransport(name string, t MailTransport) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	transport, transportName = t, name
+}
+
+// Saves the transport chosen in the admin page and starts using it,
+// unless it's overridden (see TransportOverride).
+func SetTransport(name string) error {
+	t, err := NewTransport(name)
+	if err != nil {
+		return err
+	}
+	_, err = MailDb.Exec(`INSERT INTO mail_settings (key, value) VALUES ('transport', ?)
+	ON CONFLICT(key) DO UPDATE SET value = excluded.value`, name)
+	if err != nil {
+		return fmt.Errorf("failed to save the mail transport: %v", err)
+	}
+	if override, _ := TransportOverride(); override == "" {
+		// the name can come from a fiber request, which reuses its buffer after the request
+		UseTransport(strings.Clone(name), t)
+	}
+	return nil
+}
+
+// Returns the transport forced by the environment and why, or empty strings if
+// the transport chosen in the admin page is used.
+func TransportOverride() (string, string) {
+	if Env.MAIL_TRANSPORT != "" {
+		return Env.MAIL_TRANSPORT, "Set by the MAIL_TRANSPORT environment variable."
+	}
+	if Env.ENVIRONMENT == "development" {
+		return TransportMailbox, "Emails are captured in the dev mailbox (/dev/mailbox) because ENVIRONMENT=development."
+	}
+	return "", ""
+}
+
+// Picks the transport from the environment, then the admin setting, and defaults to SMTP.
+func loadTransport() error {
+	name, _ := TransportOverride()
+	if name == "" {
+		err := MailDb.Get(&name, `SELECT value FROM mail_settings WHERE key = 'transport'`)
+		if err != nil {
+			name = TransportSMTP
+		}
+	}
+	t, err := NewTransport(name)
+	if err != nil {
+		return err
+	}
+	UseTransport(name, t)
+	return nil
+}
+
+// Returns whether emails can be sent with the current transport.
+// Only SMTP needs to be configured first, in the admin page.
+func CanSendMail() bool {
+	t, _ := CurrentTransport()
+	if _, ok := t.(smtpTransport); ok {
+		m := GetMailer()
+		return m != nil && IsValidMailer(m)
+	}
+	return t != nil
+}
+
+// Returns the sender of messages that don't set one.
+func defaultFrom() string {
+	if m := GetMailer(); m != nil {
+		if m.From != "" {
+			return m.From
+		}
+		_, err := mail.ParseAddress(m.Username)
+		if err == nil {
+			return m.Username
+		}
+	}
+	if Env.MAIL_FROM != "" {
+		return Env.MAIL_FROM
+	}
+	host := "localhost"
+	u, err := url.Parse(Env.BASE_URL)
+	if err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return "noreply@" + host
+}
+
+// Sends messages with the SMTP server configured in the admin page.
+// It always uses the current settings, so changes apply to the next message.
+type smtpTransport struct{}
+
+func (t smtpTransport) Send(msg *Message) error {
+	_, err := t.SendWithResponse(msg)
+	return err
+}
+
+func (smtpTransport) SendWithResponse(msg *Message) (string, error) {
+	m := GetMailer()
+	if m == nil {
+		return "", fmt.Errorf("mailer is not configured")
+	}
+	return m.SendWithResponse(msg)
+}
+
+// Pipes messages to a local sendmail compatible binary (sendmail, postfix, exim, msmtp...).
+type SendmailTransport struct {
+	Path string   // Path of the binary. Default: /usr/sbin/sendmail
+	Args []string // Extra arguments, before the recipients
+}
+
+func (s *SendmailTransport) Send(msg *Message) error {
+	from, to, err := msg.envelope()
+	if err != nil {
+		return err
+	}
+	path := s.Path
+	if path == "" {
+		path = "/usr/sbin/sendmail"
+	}
+
+	// -i: a line with a single dot doesn't end the message, -f: envelope sender
+	args := append([]string{"-i", "-f", from}, s.Args...)
+	args = append(args, "--")
+	args = append(args, to...)
+	cmd := exec.Command(path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %v", path, err)
+	}
+
+	_, writeErr := msg.WriteTo(stdin)
+	stdin.Close()
+	err = cmd.Wait()
+	if writeErr != nil {
+		return fmt.Errorf("failed to write message: %v", writeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Saves every message as an .eml file in a directory instead of sending it.
+// Most email clients can open them.
+type FileTransport struct {
+	Dir string // Where to save the files, created if needed
+}
+
+func (f *FileTransport) Send(msg *Message) error {
+	_, err := f.SendWithResponse(msg)
+	return err
+}
+
+// Returns the path of the saved file as the response.
+func (f *FileTransport) SendWithResponse(msg *Message) (string, error) {
+	_, _, err := msg.envelope()
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(f.Dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first, so other tools never see half-written messages
+	tmp, err := os.CreateTemp(f.Dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = msg.WriteTo(tmp)
+	if err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write message: %v", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	// the names sort by date
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), strings.TrimPrefix(filepath.Base(tmp.Name()), ".tmp-"))
+	path := filepath.Join(f.Dir, name)
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", err
+	}
+	return "saved as " + path, nil
+}
+
+// A message recorded by MemoryTransport.
+type SentMessage struct {
+	From    string   // Envelope sender
+	To      []string // Envelope recipients
+	Message *Message
+	Raw     []byte // The message as it would have been sent
+}
+
+// Keeps the sent messages in memory, to check them in tests. Safe for concurrent use.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []SentMessage
+}
+
+func (t *MemoryTransport) Send(msg *Message) error {
+	from, to, err := msg.envelope()
+	if err != nil {
+		return err
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, SentMessage{From: from, To: to, Message: msg, Raw: raw})
+	return nil
+}
+
+// Returns the messages sent so far, oldest first.
+func (t *MemoryTransport) Messages() []SentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.messages)
+}
+
+// Forgets the messages sent so far.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
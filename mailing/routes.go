@@ -0,0 +1,471 @@
+package mailing
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-on-rails/auth"
+	"go-on-rails/common"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// This module holds the pages about emails.
+// /admin/mail is the delivery log: every email of the outbox (see common/outbox.go),
+// its status and the errors of the failed attempts, and the rate limits (see common/ratelimit.go).
+// /admin/emails lets admins edit the emails sent by the app (see common/emailtemplate.go).
+// /admin/suppressions lists the addresses that bounced or complained (see common/bounce.go),
+// which are reported by the mail server to /bounces.
+// In development, /dev/mailbox shows the emails captured by the mailbox transport
+// (see common/mailbox.go) so links like /reset-password?token=... can be clicked
+// without an SMTP server.
+
+func AddRoutes(app *fiber.App) {
+	admin := &MailAdminHandlers{}
+	app.Get("/admin/mail", admin.get_log)
+	app.Get("/admin/mail/:id", admin.get_entry)
+	app.Post("/admin/mail/:id/resend", admin.post_resend)
+	app.Post("/admin/mail/rate-limits", admin.post_rate_limits)
+	app.Get("/admin/emails", admin.get_templates)
+	app.Get("/admin/emails/:name", admin.get_template)
+	app.Post("/admin/emails/:name", admin.post_template)
+	app.Post("/admin/emails/:name/preview", admin.post_template_preview)
+	app.Post("/admin/emails/:name/revert/:id", admin.post_template_revert)
+	app.Get("/admin/suppressions", admin.get_suppressions)
+	app.Post("/admin/suppressions/delete", admin.post_delete_suppression)
+
+	// bounces and complaints posted by the mail server, see common/bounce.go
+	app.Post("/bounces", post_bounce)
+
+	// the captured emails contain password reset links, never expose them outside development
+	if common.Env.ENVIRONMENT == "development" {
+		mailbox := &MailboxHandlers{}
+		app.Get("/dev/mailbox", mailbox.get_mailbox)
+		app.Post("/dev/mailbox/clear", mailbox.post_clear)
+		app.Get("/dev/mailbox/:id", mailbox.get_message)
+		app.Get("/dev/mailbox/:id/html", mailbox.get_message_html)
+		app.Get("/dev/mailbox/:id/cid/:cid", mailbox.get_inline_image)
+		app.Post("/dev/mailbox/:id/delete", mailbox.post_delete)
+	}
+}
+
+type MailAdminHandlers struct {
+}
+
+func (m *MailAdminHandlers) get_log(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	filter := common.OutboxFilter{
+		Query:  strings.TrimSpace(c.Query("q")),
+		Status: c.Query("status"),
+	}
+	entries, err := common.SearchOutbox(filter)
+	if err != nil {
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get the delivery log:", err.Error()))
+	}
+
+	return common.RenderTempl(c, mail_log_page(auth.Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, filter, entries, common.GetRateLimits()))
+}
+
+func (m *MailAdminHandlers) get_entry(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Redirect("/admin/mail?error=Invalid email ID")
+	}
+	entry, err := common.GetOutboxEntry(id)
+	if err == sql.ErrNoRows {
+		return c.Redirect("/admin/mail?error=Email not found")
+	}
+	if err != nil {
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get the email:", err.Error()))
+	}
+
+	// messages with attachments can be big, only show their beginning
+	raw := entry.Raw[:min(len(entry.Raw), 256<<10)]
+
+	return common.RenderTempl(c, mail_entry_page(auth.Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, entry, string(raw)))
+}
+
+func (m *MailAdminHandlers) post_resend(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Redirect("/admin/mail?error=Invalid email ID")
+	}
+	newID, err := common.ResendOutboxEntry(id)
+	if err != nil {
+		return c.Redirect(fmt.Sprintf("/admin/mail/%d?error=Can't resend the email because %s", id, err.Error()))
+	}
+
+	return c.Redirect(fmt.Sprintf("/admin/mail/%d?success=Email queued again", newID))
+}
+
+func (m *MailAdminHandlers) post_rate_limits(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	var limits common.RateLimits
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{{"per_minute", &limits.PerMinute}, {"per_recipient", &limits.PerRecipient}, {"per_template", &limits.PerTemplate}} {
+		*field.value, err = strconv.Atoi(strings.TrimSpace(c.FormValue(field.name)))
+		if err != nil {
+			return c.Redirect("/admin/mail?error=Invalid " + strings.ReplaceAll(field.name, "_", " ") + " limit")
+		}
+	}
+	limits.RecipientWindow, err = time.ParseDuration(strings.TrimSpace(c.FormValue("recipient_window")))
+	if err != nil {
+		return c.Redirect("/admin/mail?error=Invalid recipient window, use a duration like 1h")
+	}
+	limits.TemplateWindow, err = time.ParseDuration(strings.TrimSpace(c.FormValue("template_window")))
+	if err != nil {
+		return c.Redirect("/admin/mail?error=Invalid template window, use a duration like 1h")
+	}
+	limits.Action = c.FormValue("action")
+
+	err = common.SetRateLimits(limits)
+	if err != nil {
+		return c.Redirect("/admin/mail?error=Can't save the rate limits because " + err.Error())
+	}
+	return c.Redirect("/admin/mail?success=Rate limits saved")
+}
+
+func (m *MailAdminHandlers) get_templates(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	templates := common.EmailTemplates()
+	current := map[string]common.EmailTemplateVersion{}
+	for _, t := range templates {
+		current[t.Name], err = common.CurrentEmailTemplate(t.Name)
+		if err != nil {
+			return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get the email templates:", err.Error()))
+		}
+	}
+
+	return common.RenderTempl(c, email_templates_page(auth.Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, templates, current))
+}
+
+func (m *MailAdminHandlers) get_template(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	t, ok := common.GetEmailTemplate(c.Params("name"))
+	if !ok {
+		return c.Redirect("/admin/emails?error=Email template not found")
+	}
+	current, err := common.CurrentEmailTemplate(t.Name)
+	if err != nil {
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get the email template:", err.Error()))
+	}
+	history, err := common.EmailTemplateHistory(t.Name)
+	if err != nil {
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get the email template history:", err.Error()))
+	}
+
+	return common.RenderTempl(c, email_template_page(auth.Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, t, current, history))
+}
+
+func (m *MailAdminHandlers) post_template(c *fiber.Ctx) error {
+	userId, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	name := c.Params("name")
+	_, err = common.SaveEmailTemplate(common.EmailTemplateVersion{
+		Name:    name,
+		Subject: strings.TrimSpace(c.FormValue("subject")),
+		HTML:    c.FormValue("html"),
+		Text:    c.FormValue("text"),
+	}, adminEmail(userId))
+	if err != nil {
+		return c.Redirect("/admin/emails/" + name + "?error=Can't save the email because " + err.Error())
+	}
+	return c.Redirect("/admin/emails/" + name + "?success=Email saved")
+}
+
+// Renders the content of the editor with the sample data, without saving it.
+func (m *MailAdminHandlers) post_template_preview(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).SendString("You do not have permission to view the admin page")
+	}
+
+	t, ok := common.GetEmailTemplate(c.Params("name"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Email template not found")
+	}
+	subject, html, text, err := common.RenderEmailTemplate(common.EmailTemplateVersion{
+		Name:    t.Name,
+		Subject: strings.TrimSpace(c.FormValue("subject")),
+		HTML:    c.FormValue("html"),
+		Text:    c.FormValue("text"),
+	}, t.SampleData())
+	if err == nil && text == "" {
+		text = common.HTMLToText(html)
+	}
+	return common.RenderTempl(c, email_template_preview(subject, html, text, err))
+}
+
+func (m *MailAdminHandlers) post_template_revert(c *fiber.Ctx) error {
+	userId, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	name := c.Params("name")
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Redirect("/admin/emails/" + name + "?error=Invalid version")
+	}
+	_, err = common.RevertEmailTemplate(name, id, adminEmail(userId))
+	if err == sql.ErrNoRows {
+		return c.Redirect("/admin/emails/" + name + "?error=Version not found")
+	}
+	if err != nil {
+		return c.Redirect("/admin/emails/" + name + "?error=Can't revert the email because " + err.Error())
+	}
+	return c.Redirect("/admin/emails/" + name + "?success=Email reverted")
+}
+
+func (m *MailAdminHandlers) get_suppressions(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	query := strings.TrimSpace(c.Query("q"))
+	suppressions, err := common.SearchSuppressions(query)
+	if err != nil {
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get the suppressions:", err.Error()))
+	}
+
+	return common.RenderTempl(c, suppressions_page(auth.Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, query, suppressions))
+}
+
+func (m *MailAdminHandlers) post_delete_suppression(c *fiber.Ctx) error {
+	_, err := auth.IsAdmin(c)
+	if err != nil {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	email := c.FormValue("email")
+	err = common.RemoveSuppression(email)
+	if err != nil {
+		return c.Redirect("/admin/suppressions?error=Can't clear the suppression because " + err.Error())
+	}
+	return c.Redirect("/admin/suppressions?success=Emails will be sent to " + email + " again")
+}
+
+// Receives a raw DSN or ARF report, posted by the mail server with the BOUNCE_WEBHOOK_TOKEN.
+// Example:
+//
+//	curl -H "Authorization: Bearer $BOUNCE_WEBHOOK_TOKEN" -H "Content-Type: message/rfc822" --data-binary @bounce.eml https://example.com/bounces
+func post_bounce(c *fiber.Ctx) error {
+	if common.Env.BOUNCE_WEBHOOK_TOKEN == "" {
+		return c.Status(fiber.StatusNotFound).SendString("Bounce processing is disabled, set BOUNCE_WEBHOOK_TOKEN to enable it")
+	}
+	token := c.Query("token")
+	if bearer, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		token = bearer
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(common.Env.BOUNCE_WEBHOOK_TOKEN)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid token")
+	}
+
+	bounces, err := common.ProcessBounce(bytes.NewReader(c.Body()))
+	if errors.Is(err, common.ErrNotReport) {
+		// not an error of the sender, e.g. an out of office reply to the Return-Path address
+		return c.SendString("Ignored: " + err.Error())
+	}
+	if err != nil && bounces == nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	var b strings.Builder
+	for _, bounce := range bounces {
+		status := ""
+		if bounce.Suppressed {
+			status = " (suppressed)"
+		} else if bounce.Permanent {
+			status = " (ignored, no message sent to it in the outbox)"
+		}
+		fmt.Fprintf(&b, "%s %s: %s%s\n", bounce.Kind, bounce.Recipient, bounce.Reason, status)
+	}
+	return c.SendString(common.TernaryIf(b.Len() > 0, b.String(), "No failed recipients\n"))
+}
+
+// Returns the email of the user, to record who edited an email template.
+func adminEmail(userId int) string {
+	var email string
+	err := auth.AuthDb.Get(&email, `SELECT email FROM users WHERE id = ?`, userId)
+	if err != nil {
+		return fmt.Sprintf("user %d", userId)
+	}
+	return email
+}
+
+type MailboxHandlers struct {
+}
+
+func (m *MailboxHandlers) get_mailbox(c *fiber.Ctx) error {
+	var mails []common.MailboxMessage
+	err := common.MailDb.Select(&mails, `SELECT id, sender, recipients, subject, created_at FROM mailbox ORDER BY id DESC`)
+	if err != nil {
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get the mailbox:", err.Error()))
+	}
+
+	return common.RenderTempl(c, mailbox_page(auth.Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, mails))
+}
+
+func (m *MailboxHandlers) post_clear(c *fiber.Ctx) error {
+	_, err := common.MailDb.Exec(`DELETE FROM mailbox`)
+	if err != nil {
+		return c.Redirect("/dev/mailbox?error=Can't clear the mailbox because " + err.Error())
+	}
+	return c.Redirect("/dev/mailbox?success=Mailbox cleared")
+}
+
+func (m *MailboxHandlers) post_delete(c *fiber.Ctx) error {
+	_, err := common.MailDb.Exec(`DELETE FROM mailbox WHERE id = ?`, c.Params("id"))
+	if err != nil {
+		return c.Redirect("/dev/mailbox?error=Can't delete the email because " + err.Error())
+	}
+	return c.Redirect("/dev/mailbox?success=Email deleted")
+}
+
+func (m *MailboxHandlers) get_message(c *fiber.Ctx) error {
+	mail, parsed, err := getMailboxMessage(c.Params("id"))
+	if err == sql.ErrNoRows {
+		return common.RenderTempl(c, common.ErrorPage("🤷 404", "Email not found", "It may have been deleted."))
+	}
+	if err != nil {
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get the email:", err.Error()))
+	}
+
+	view := c.Query("view", common.TernaryIf(parsed.HTML != "", "html", "text"))
+	return common.RenderTempl(c, mailbox_message_page(mail, parsed, view))
+}
+
+// Serves the HTML body on its own, to be shown in a sandboxed iframe.
+func (m *MailboxHandlers) get_message_html(c *fiber.Ctx) error {
+	_, parsed, err := getMailboxMessage(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Email not found")
+	}
+
+	// links open in the main window, inline images are served by get_inline_image
+	html := strings.NewReplacer(
+		`"cid:`, `"/dev/mailbox/`+c.Params("id")+`/cid/`,
+		`'cid:`, `'/dev/mailbox/`+c.Params("id")+`/cid/`,
+	).Replace(parsed.HTML)
+	base := `<base target="_top">`
+	if i := strings.Index(strings.ToLower(html), "<head>"); i != -1 {
+		html = html[:i+len("<head>")] + base + html[i+len("<head>"):]
+	} else {
+		html = base + html
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.SendString(html)
+}
+
+func (m *MailboxHandlers) get_inline_image(c *fiber.Ctx) error {
+	_, parsed, err := getMailboxMessage(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Email not found")
+	}
+	for _, a := range parsed.Attachments {
+		if a.ContentID != "" && a.ContentID == c.Params("cid") {
+			// the part comes from the email, so only images are shown: anything else (e.g. HTML
+			// or SVG with scripts) would run in the app's origin, it's downloaded instead
+			c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+			if strings.HasPrefix(a.ContentType, "image/") && a.ContentType != "image/svg+xml" {
+				c.Set(fiber.HeaderContentType, a.ContentType)
+			} else {
+				c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+				c.Set(fiber.HeaderContentDisposition, "attachment")
+			}
+			return c.Send(a.Data)
+		}
+	}
+	return c.Status(fiber.StatusNotFound).SendString("Image not found")
+}
+
+func getMailboxMessage(id string) (common.MailboxMessage, *common.ParsedMessage, error) {
+	var mail common.MailboxMessage
+	err := common.MailDb.Get(&mail, `SELECT id, sender, recipients, subject, raw, created_at FROM mailbox WHERE id = ?`, id)
+	if err != nil {
+		return mail, nil, err
+	}
+	parsed, err := common.ParseMessage(bytes.NewReader(mail.Raw))
+	return mail, parsed, err
+}
+
+// A piece of text, which is a link if URL is true.
+type text_segment struct {
+	Text string
+	URL  bool
+}
+
+var urlRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// Splits text into plain text and URLs, so the URLs can be rendered as links.
+func linkify(text string) []text_segment {
+	var segments []text_segment
+	last := 0
+	for _, loc := range urlRegex.FindAllStringIndex(text, -1) {
+		// punctuation at the end of a URL is usually part of the sentence
+		end := loc[0] + len(strings.TrimRight(text[loc[0]:loc[1]], ".,;:!?)'"))
+		segments = append(segments, text_segment{Text: text[last:loc[0]]}, text_segment{Text: text[loc[0]:end], URL: true})
+		last = end
+	}
+	return append(segments, text_segment{Text: text[last:]})
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"go-on-rails/auth"
+	"go-on-rails/common"
+	"go-on-rails/mailing"
 	"go-on-rails/marketing"
 	"log"
 
@@ -15,16 +18,40 @@ import (
 // Don't put too much logic here, just enough to get the app running.
 
 func main() {
-	log.Println("Starting server on port 3000")
+	err := common.LoadEnv()
+	if err != nil {
+		log.Fatalf("Error loading the environment: %v", err)
+	}
+
+	log.Printf("Starting server on port %d", common.Env.PORT)
 	app := fiber.New()
 	app.Use(logger.New())
 
+	// encrypt the secrets saved in plain text or with an old key
+	reencrypted, err := common.ReencryptSecrets()
+	if err != nil {
+		log.Printf("Error re-encrypting secrets: %v", err)
+	} else if reencrypted > 0 {
+		log.Printf("Re-encrypted %d secrets with the current key", reencrypted)
+	}
+
+	err = common.LoadMailSettings()
+	if err != nil {
+		log.Fatalf("Error loading mail settings: %v", err)
+	}
+
+	// send the queued emails in the background
+	common.StartOutbox()
+	// suppress the addresses that bounce, if BOUNCE_MAILDIR is set
+	common.StartBounceMaildir()
+
 	// routes
 	app.Static("/", "./public")
 	marketing.AddRoutes(app)
 	auth.AddRoutes(app)
+	mailing.AddRoutes(app)
 
-	err := app.Listen(":3000")
+	err = app.Listen(fmt.Sprintf(":%d", common.Env.PORT))
 	if err != nil {
 		log.Println("Error starting server")
 		log.Println(err)